@@ -3,18 +3,39 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/scottferg/Go-SDL/sdl"
 	"github.com/remogatto/application"
 	sms "github.com/remogatto/sms/segamastersystem"
 	"github.com/remogatto/z80"
+	"github.com/scottferg/Go-SDL/sdl"
 	"log"
+	"math"
 	"os"
 	"runtime/pprof"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const NUM_FRAMES_FOR_PROFILING = 10000
 
+const (
+	FRAME_RATE         = 50 // Frames per second at normal speed
+	FAST_FORWARD_SPEED = 4
+	MIN_SPEED          = 0.25
+	MAX_SPEED          = 8
+)
+
+// Pacing modes of the emulation.
+const (
+	SYNC_TIMER = "timer" // Frames are timed by a ticker
+	SYNC_VSYNC = "vsync" // Frames follow the flips of the screen
+)
+
+const (
+	VSYNC_CHECK_FLIPS = 25  // Flips timed before trusting vsync
+	VSYNC_MAX_RATE    = 240 // Refresh rate above which the flips can't be waiting for the retrace
+)
+
 // drainTicker drains the remaining ticks from the given tick.
 func drainTicker(ticker *time.Ticker) {
 loop:
@@ -27,6 +48,14 @@ loop:
 	}
 }
 
+// onOff returns "on" or "off".
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
 // showDisassembled prints out disassembled code.
 func showDisassembled(instructions []z80.DebugInstruction) {
 	arrow := ""
@@ -40,28 +69,56 @@ func showDisassembled(instructions []z80.DebugInstruction) {
 	}
 }
 
+// unthrottled is always ready to be received from, so that the
+// emulator runs as fast as possible.
+var unthrottled = make(chan time.Time)
+
+func init() {
+	close(unthrottled)
+}
+
 // emulatorLoop sends a cmdRenderFrame command to the rendering backend
-// (displayLoop) each 1/50 second.
+// (displayLoop) each 1/50 second, or faster or slower depending on
+// the speed.
 type emulatorLoop struct {
 	ticker           *time.Ticker
+	period           time.Duration // Between two frames, 0 when unthrottled
+	paused           bool
 	sms              *sms.SMS
 	pause, terminate chan int
 	pauseEmulation   chan int
+	rewind           chan bool
+	rewinding        bool
+	periodChange     chan time.Duration
+	advance          chan int // Wakes the loop up when advances are pending
+	advances         int32    // Frames to advance, updated atomically
+	vsync            <-chan time.Time // Flips of the screen, nil when timed by the ticker
+	repeat           chan<- int       // Flips the last frame again
+	waitVsync        bool             // A frame was sent since the last flip
+	lastFlip         time.Time
+	owed             time.Duration // Emulated time the flips are ahead of
+	firstFlip        time.Time     // Of the flips being timed
+	flipsTimed       int
+	vsyncChecked     bool
 }
 
 // newEmulatorLoop returns a new emulatorLoop instance.
-func newEmulatorLoop(displayLoop sms.DisplayLoop) *emulatorLoop {
+func newEmulatorLoop() *emulatorLoop {
 	emulatorLoop := &emulatorLoop{
-		ticker:         time.NewTicker(time.Duration(1e9 / 50)), // 50 Hz
-		sms:            sms.NewSMS(displayLoop),
+		period:         time.Second / FRAME_RATE,
+		sms:            sms.NewSMS(),
 		pause:          make(chan int),
 		terminate:      make(chan int),
 		pauseEmulation: make(chan int),
+		rewind:         make(chan bool, 1),
+		periodChange:   make(chan time.Duration, 1),
+		advance:        make(chan int, 1),
 	}
 	if flag.Arg(0) == "" {
 		return nil
 	}
 	emulatorLoop.sms.LoadROM(flag.Arg(0))
+	emulatorLoop.resetTicker()
 	return emulatorLoop
 }
 
@@ -77,6 +134,116 @@ func (l *emulatorLoop) Terminate() chan int {
 	return l.terminate
 }
 
+// vsyncPacing returns whether the frames follow the flips of the
+// screen. This is only done at normal speed.
+func (l *emulatorLoop) vsyncPacing() bool {
+	return l.vsync != nil && l.period == time.Second/FRAME_RATE
+}
+
+// resetTicker starts ticking at the current period, unless the
+// emulation is paused, unthrottled or paced by the screen.
+func (l *emulatorLoop) resetTicker() {
+	if l.ticker != nil {
+		l.ticker.Stop()
+		drainTicker(l.ticker)
+		l.ticker = nil
+	}
+	l.waitVsync = false
+	// Pauses and speed changes would spoil the timing of the flips
+	l.firstFlip, l.flipsTimed = time.Time{}, 0
+	l.lastFlip, l.owed = time.Time{}, l.period
+	if !l.paused && l.period > 0 && !l.vsyncPacing() {
+		l.ticker = time.NewTicker(l.period)
+	}
+}
+
+// ticks returns the channel the frames are timed by.
+func (l *emulatorLoop) ticks() <-chan time.Time {
+	switch {
+	case l.paused:
+		return nil
+	case l.waitVsync:
+		return l.vsync
+	case l.ticker == nil:
+		return unthrottled
+	}
+	return l.ticker.C
+}
+
+// setRewinding starts or stops rewinding. It never blocks, replacing
+// a value not yet seen by the loop.
+func (l *emulatorLoop) setRewinding(rewinding bool) {
+	select {
+	case <-l.rewind:
+	default:
+	}
+	l.rewind <- rewinding
+}
+
+// setPeriod changes the time between two frames, 0 running the
+// emulator as fast as possible. It never blocks, replacing a value
+// not yet seen by the loop.
+func (l *emulatorLoop) setPeriod(period time.Duration) {
+	select {
+	case <-l.periodChange:
+	default:
+	}
+	l.periodChange <- period
+}
+
+// advanceFrame renders a single frame while the emulation is paused.
+// It never blocks, the requests not yet seen by the loop being
+// counted so that none is lost.
+func (l *emulatorLoop) advanceFrame() {
+	atomic.AddInt32(&l.advances, 1)
+	select {
+	case l.advance <- 0:
+	default:
+	}
+}
+
+// frameDue tells whether a frame is due at the flip at the given
+// time. The display seldom refreshes at the frame rate of the
+// machine, so the time between the flips is added up and a frame is
+// emulated whenever a whole period is owed, the last frame being
+// flipped again otherwise. At 60 Hz, 5 frames out of 6 flips keep
+// the emulation at 50 frames per second.
+func (l *emulatorLoop) frameDue(flip time.Time) bool {
+	if !l.lastFlip.IsZero() {
+		l.owed += flip.Sub(l.lastFlip)
+	}
+	l.lastFlip = flip
+	if l.owed < l.period {
+		return false
+	}
+	// Don't try to catch up after a stall
+	l.owed = time.Duration(math.Min(float64(l.owed-l.period), float64(l.period)))
+	return true
+}
+
+// checkVsync times the first flips, falling back to the ticker if
+// they don't wait for a vertical retrace at a usable rate. The
+// double buffered surface alone is no guarantee of it.
+func (l *emulatorLoop) checkVsync(flip time.Time) {
+	if l.vsyncChecked {
+		return
+	}
+	if l.firstFlip.IsZero() {
+		l.firstFlip = flip
+		return
+	}
+	if l.flipsTimed++; l.flipsTimed < VSYNC_CHECK_FLIPS {
+		return
+	}
+	l.vsyncChecked = true
+	interval := flip.Sub(l.firstFlip) / VSYNC_CHECK_FLIPS
+	if interval < time.Second/VSYNC_MAX_RATE {
+		application.Logf("Flips every %s, vsync not in effect: using the timer", interval)
+		l.vsync = nil
+		l.resetTicker()
+	}
+}
+
 // Run runs emulatorLoop.
 // The loop sends a cmdRenderFrame command to the sms command channel
 // each time it receives a value from the ticker.
@@ -84,19 +251,40 @@ func (l *emulatorLoop) Run() {
 	for {
 		select {
 		case <-l.pause:
-			l.ticker.Stop()
+			l.paused = true
+			l.resetTicker()
 			l.pause <- 0
 		case <-l.terminate:
 			l.terminate <- 0
-		case <-l.ticker.C:
-			l.sms.Command <- sms.CmdRenderFrame{}
-		case <-l.pauseEmulation:
-			if l.sms.Paused {
-				l.ticker.Stop()
-				drainTicker(l.ticker)
+		case t := <-l.ticks():
+			if l.waitVsync {
+				l.checkVsync(t)
+				if l.vsync != nil && !l.frameDue(t) {
+					select {
+					case l.repeat <- 0:
+					default:
+					}
+					break
+				}
+			}
+			if l.rewinding {
+				l.sms.Command <- sms.CmdRewindFrame{}
 			} else {
-				l.ticker = time.NewTicker(time.Duration(1e9 / 50))
+				l.sms.Command <- sms.CmdRenderFrame{}
 			}
+			l.waitVsync = l.vsyncPacing()
+		case l.rewinding = <-l.rewind:
+			// Rewinding past the oldest frame shows nothing
+			l.waitVsync = false
+		case l.period = <-l.periodChange:
+			l.resetTicker()
+		case <-l.advance:
+			for n := atomic.SwapInt32(&l.advances, 0); n > 0 && l.paused; n-- {
+				l.sms.Command <- sms.CmdRenderFrame{}
+			}
+		case <-l.pauseEmulation:
+			l.paused = l.sms.Paused
+			l.resetTicker()
 			l.pauseEmulation <- 0
 		}
 	}
@@ -110,19 +298,154 @@ type commandLoop struct {
 	displayLoop      sms.DisplayLoop
 	numOfSentFrames  int
 	cpuProfiling     bool
+	border           bool
+	lastFrame        sms.DisplayData
+	recorder         sms.Recorder
+	glasses          *sms.Glasses
+
+	// Speed of the emulation
+	speed       float64
+	fastForward bool
+	turbo       bool
+	unthrottled bool
+	frameSkip   bool // Drop the frames the display isn't ready for
 }
 
 // newCommandLoop returns a commandLoop instance.
-func newCommandLoop(emulatorLoop *emulatorLoop, displayLoop sms.DisplayLoop, cpuProfiling bool) *commandLoop {
+func newCommandLoop(emulatorLoop *emulatorLoop, displayLoop sms.DisplayLoop, cpuProfiling, border bool) *commandLoop {
 	return &commandLoop{
 		emulatorLoop: emulatorLoop,
 		displayLoop:  displayLoop,
 		cpuProfiling: cpuProfiling,
+		border:       border,
+		speed:        1,
 		pause:        make(chan int),
 		terminate:    make(chan int),
 	}
 }
 
+// show sends a frame to the display, recording it if needed.
+func (l *commandLoop) show(frame *sms.DisplayData) {
+	if l.glasses != nil {
+		l.glasses.Compose(frame)
+	}
+	// Keep a copy, the frame is owned by the display once sent.
+	l.lastFrame = *frame
+	if l.recorder != nil {
+		if err := l.recorder.WriteFrame(frame); err != nil {
+			application.Logf("Recording failed: %s", err)
+			l.stopRecording()
+		}
+	}
+	// Frames advanced one at a time are never skipped
+	if l.frameSkip && !l.emulatorLoop.sms.Paused {
+		select {
+		case l.displayLoop.Display() <- frame:
+		default:
+			frame.Release()
+		}
+	} else {
+		l.displayLoop.Display() <- frame
+	}
+	l.numOfSentFrames++
+	if l.numOfSentFrames > NUM_FRAMES_FOR_PROFILING && l.cpuProfiling {
+		application.Exit()
+	}
+}
+
+// updateSpeed sets the period of the emulator loop according to the
+// speed settings.
+func (l *commandLoop) updateSpeed() {
+	speed := l.speed
+	if l.fastForward || l.turbo {
+		speed = FAST_FORWARD_SPEED
+	}
+	period := time.Duration(0)
+	if !l.unthrottled {
+		period = time.Duration(float64(time.Second) / (FRAME_RATE * speed))
+	}
+	l.frameSkip = l.unthrottled || speed > 1
+	l.emulatorLoop.setPeriod(period)
+}
+
+// setSpeed changes the normal speed, within MIN_SPEED and MAX_SPEED.
+func (l *commandLoop) setSpeed(speed float64) {
+	l.speed = math.Max(MIN_SPEED, math.Min(MAX_SPEED, speed))
+	application.Logf("Speed %gx", l.speed)
+	l.updateSpeed()
+}
+
+// screenshot saves the last frame sent to the display as a PNG file.
+func (l *commandLoop) screenshot(filename string) {
+	if l.lastFrame.Height == 0 {
+		application.Logf("%s", "No frame to take a screenshot of")
+		return
+	}
+	if filename == "" {
+		filename = fmt.Sprintf("sms-%s.png", time.Now().Format("20060102-150405.000"))
+	}
+	if err := l.lastFrame.WritePNG(filename, l.border); err != nil {
+		application.Logf("Screenshot failed: %s", err)
+		return
+	}
+	application.Logf("Screenshot saved to %s", filename)
+}
+
+// toggleRecording starts recording a video or stops the recording
+// in progress.
+func (l *commandLoop) toggleRecording(filename string) {
+	if l.recorder != nil {
+		l.stopRecording()
+		return
+	}
+	if filename == "" {
+		filename = fmt.Sprintf("sms-%s.gif", time.Now().Format("20060102-150405.000"))
+	}
+	recorder, err := sms.NewRecorder(filename, l.border)
+	if err != nil {
+		application.Logf("Recording failed: %s", err)
+		return
+	}
+	l.recorder = recorder
+	application.Logf("Recording to %s", filename)
+}
+
+// stopRecording finalizes the video being recorded.
+func (l *commandLoop) stopRecording() {
+	if err := l.recorder.Close(); err != nil {
+		application.Logf("Recording failed: %s", err)
+	} else {
+		application.Logf("%s", "Recording stopped")
+	}
+	l.recorder = nil
+}
+
+// toggleVGMLog starts logging the sound chip writes into a VGM file
+// or stops the logging in progress.
+func (l *commandLoop) toggleVGMLog(filename string) {
+	if l.emulatorLoop.sms.VGMLogging() {
+		l.stopVGMLog()
+		return
+	}
+	if filename == "" {
+		filename = fmt.Sprintf("sms-%s.vgm", time.Now().Format("20060102-150405.000"))
+	}
+	if err := l.emulatorLoop.sms.StartVGMLog(filename); err != nil {
+		application.Logf("VGM logging failed: %s", err)
+		return
+	}
+	application.Logf("Logging music to %s", filename)
+}
+
+// stopVGMLog writes the VGM file being logged.
+func (l *commandLoop) stopVGMLog() {
+	if err := l.emulatorLoop.sms.StopVGMLog(); err != nil {
+		application.Logf("VGM logging failed: %s", err)
+	} else {
+		application.Logf("%s", "VGM logging stopped")
+	}
+}
+
 // Pause returns the pause channel of the loop.
 // If a value is sent to this channel, the loop will be paused.
 func (l *commandLoop) Pause() chan int {
@@ -143,32 +466,100 @@ func (l *commandLoop) Run() {
 		case <-l.pause:
 			l.pause <- 0
 		case <-l.terminate:
+			if l.recorder != nil {
+				l.stopRecording()
+			}
+			if l.emulatorLoop.sms.VGMLogging() {
+				l.stopVGMLog()
+			}
+			if l.emulatorLoop.sms.MovieRecording() {
+				if err := l.emulatorLoop.sms.StopMovie(); err != nil {
+					application.Logf("Movie recording failed: %s", err)
+				}
+			}
 			l.terminate <- 0
 		case _cmd := <-l.emulatorLoop.sms.Command:
 			switch cmd := _cmd.(type) {
 
 			case sms.CmdRenderFrame:
-				l.displayLoop.Display() <- l.emulatorLoop.sms.RenderFrame()
-				l.numOfSentFrames++
-				if l.numOfSentFrames > NUM_FRAMES_FOR_PROFILING && l.cpuProfiling {
-					application.Exit()
+				l.show(l.emulatorLoop.sms.RenderFrame())
+
+			case sms.CmdRewind:
+				// Replace a value not yet seen by the emulator
+				// loop, so that sending never blocks.
+				l.emulatorLoop.setRewinding(cmd.Rewinding)
+
+			case sms.CmdFastForward:
+				l.fastForward = cmd.On
+				l.updateSpeed()
+
+			case sms.CmdTurbo:
+				l.turbo = !l.turbo
+				application.Logf("Turbo %s", onOff(l.turbo))
+				l.updateSpeed()
+
+			case sms.CmdSpeed:
+				l.setSpeed(l.speed * cmd.Factor)
+
+			case sms.CmdUnthrottled:
+				l.unthrottled = !l.unthrottled
+				application.Logf("Unthrottled %s", onOff(l.unthrottled))
+				l.updateSpeed()
+
+			case sms.CmdFrameAdvance:
+				l.emulatorLoop.advanceFrame()
+
+			case sms.CmdRewindFrame:
+				if frame := l.emulatorLoop.sms.Rewind(); frame != nil {
+					l.show(frame)
 				}
 
 			case sms.CmdLoadROM:
 				l.emulatorLoop.sms.LoadROM(cmd.Filename)
 
+			case sms.CmdScreenshot:
+				l.screenshot(cmd.Filename)
+
+			case sms.CmdRecord:
+				l.toggleRecording(cmd.Filename)
+
+			case sms.CmdVGMLog:
+				l.toggleVGMLog(cmd.Filename)
+
+			case sms.CmdVGMLoop:
+				l.emulatorLoop.sms.MarkVGMLoop()
+
 			case sms.CmdJoypadEvent:
 				l.emulatorLoop.sms.Joypad(cmd.Value, cmd.Event)
 
+			case sms.CmdLightPhaser:
+				l.emulatorLoop.sms.LightPhaser(cmd.X, cmd.Y, cmd.Trigger)
+
+			case sms.CmdMouse:
+				l.emulatorLoop.sms.Mouse(cmd.DX, cmd.DY, cmd.Buttons)
+
+			case sms.CmdMouseDevices:
+				cmd.Devices <- l.emulatorLoop.sms.MouseDevices()
+
 			case sms.CmdPauseEmulation:
 				l.emulatorLoop.pauseEmulation <- 0
 				<-l.emulatorLoop.pauseEmulation
 				cmd.Paused <- l.emulatorLoop.sms.Paused
 				if application.Verbose && l.emulatorLoop.sms.Paused {
-					// instructions := z80.DisassembleN(l.emulatorLoop.sms.Memory, l.emulatorLoop.sms.Cpu.PC(), 10)
-					// showDisassembled(instructions)
+					showDisassembled(l.emulatorLoop.sms.Disassemble(10))
 				}
 
+			case sms.CmdShowCurrentInstruction:
+				if !l.emulatorLoop.sms.Debugging() {
+					showDisassembled(l.emulatorLoop.sms.Disassemble(10))
+					break
+				}
+				l.emulatorLoop.sms.Debug()
+				// The debugger lets the emulation run again
+				l.emulatorLoop.sms.Paused = false
+				l.emulatorLoop.pauseEmulation <- 0
+				<-l.emulatorLoop.pauseEmulation
+
 			}
 		}
 	}
@@ -178,7 +569,8 @@ func (l *commandLoop) Run() {
 func usage() {
 	fmt.Fprintf(os.Stderr, "SMS - A Sega Master System emulator written in Go\n\n")
 	fmt.Fprintf(os.Stderr, "Usage:\n\n")
-	fmt.Fprintf(os.Stderr, "\tsms [options] game.sms\n\n")
+	fmt.Fprintf(os.Stderr, "\tsms [options] game.sms\n")
+	fmt.Fprintf(os.Stderr, "\tsms run [run options] game.sms\n\n")
 	fmt.Fprintf(os.Stderr, "Options are:\n\n")
 	flag.PrintDefaults()
 }
@@ -187,7 +579,23 @@ func main() {
 	verbose := flag.Bool("verbose", false, "verbose mode")
 	debug := flag.Bool("debug", false, "debug mode")
 	fullScreen := flag.Bool("fullscreen", false, "go fullscreen")
+	border := flag.Bool("border", false, "include the border in screenshots and videos")
+	record := flag.String("record", "", "record a video (.gif or .y4m) from the start")
+	vgm := flag.String("vgm", "", "log the music into a VGM file from the start")
+	port1 := flag.String("port1", sms.DEVICE_JOYPAD, "controller port 1 device: joypad, phaser, paddle or sportspad")
+	port2 := flag.String("port2", sms.DEVICE_JOYPAD, "controller port 2 device: joypad, phaser, paddle or sportspad")
+	glasses := flag.String("glasses", "", "show 3-D games as anaglyph, sidebyside, left or right eye frames (default: alternate frames)")
+	recordMovie := flag.String("recordmovie", "", "record the joypad input from power on into a movie file")
+	playMovie := flag.String("playmovie", "", "play back a movie file, checking that it stays in sync")
+	speed := flag.Float64("speed", 1, "emulation speed, from 0.25 to 8")
+	unthrottledFlag := flag.Bool("unthrottled", false, "run as fast as possible")
+	syncMode := flag.String("sync", SYNC_TIMER, "pace the emulation with a timer, or with the vertical retrace of the display (vsync)")
+	noSpriteLimit := flag.Bool("nospritelimit", false, "disable the limit of 8 sprites per line (reduces flicker)")
+	debugger := flag.Bool("debugger", false, "read debugger commands from the console when the d key is pressed or a breakpoint is hit")
+	breakpoints := flag.String("break", "", "comma separated list of hexadecimal breakpoint addresses (implies -debugger)")
+	watchpoints := flag.String("watch", "", "comma separated list of watchpoints, such as c000:w:changed or port:bf:=87:log (implies -debugger)")
 	cpuProfile := flag.String("cpuprofile", "", "write cpu profile to file")
+	configFile := flag.String("config", "", "key bindings file (default: "+sms.DefaultConfigPath()+")")
 	help := flag.Bool("help", false, "Show usage")
 	flag.Usage = usage
 	flag.Parse()
@@ -197,6 +605,13 @@ func main() {
 		return
 	}
 
+	if flag.Arg(0) == "run" {
+		if err := runHeadless(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
@@ -209,20 +624,110 @@ func main() {
 	application.Verbose = *verbose
 	application.Debug = *debug
 
+	config := sms.DefaultConfig()
+	configPath := *configFile
+	if configPath == "" {
+		configPath = sms.DefaultConfigPath()
+	}
+	if err := config.Load(configPath); err != nil {
+		// The default configuration file is optional
+		if *configFile != "" || !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	}
+
 	if sdl.Init(sdl.INIT_EVERYTHING) != 0 {
 		log.Fatal(sdl.GetError())
 	}
 
-	screen := sms.NewSDL2xScreen(*fullScreen)
+	if *syncMode != SYNC_TIMER && *syncMode != SYNC_VSYNC {
+		log.Fatalf("unknown pacing mode %q", *syncMode)
+	}
+	screen := sms.NewSDL2xScreenVSync(*fullScreen, *syncMode == SYNC_VSYNC)
 	sdlLoop := sms.NewSDLLoop(screen)
-	emulatorLoop := newEmulatorLoop(sdlLoop)
+	emulatorLoop := newEmulatorLoop()
 	if emulatorLoop == nil {
 		usage()
 		return
 	}
+	if *syncMode == SYNC_VSYNC && screen.VSync() {
+		emulatorLoop.vsync = sdlLoop.Flips()
+		emulatorLoop.repeat = sdlLoop.Repeat()
+		emulatorLoop.resetTicker()
+	}
+	emulatorLoop.sms.SetSpriteLimit(!*noSpriteLimit)
+	emulatorLoop.sms.EnableRewind(sms.REWIND_BUFFER_SIZE)
+	if *debugger || *breakpoints != "" || *watchpoints != "" {
+		d := sms.NewDebugger(os.Stdin, os.Stdout)
+		for _, field := range strings.Split(*breakpoints, ",") {
+			if field == "" {
+				continue
+			}
+			address, err := sms.ParseAddress(field)
+			if err != nil {
+				log.Fatalf("invalid breakpoint: %s", err)
+			}
+			d.SetBreakpoint(address)
+		}
+		for _, field := range strings.Split(*watchpoints, ",") {
+			if field == "" {
+				continue
+			}
+			w, err := sms.ParseWatchpoint(field)
+			if err != nil {
+				log.Fatalf("invalid watchpoint %q: %s", field, err)
+			}
+			d.Watch(w)
+		}
+		emulatorLoop.sms.AttachDebugger(d)
+	}
+	for port, device := range []string{*port1, *port2} {
+		if err := emulatorLoop.sms.Connect(port+1, device); err != nil {
+			log.Fatal(err)
+		}
+		switch device {
+		case sms.DEVICE_PHASER:
+			sdl.ShowCursor(sdl.ENABLE)
+		case sms.DEVICE_PADDLE, sms.DEVICE_SPORTSPAD:
+			// Keep the mouse motion flowing at the window edges
+			sdl.ShowCursor(sdl.DISABLE)
+			sdl.WM_GrabInput(sdl.GRAB_ON)
+		}
+	}
 	cpuProfiling := *cpuProfile != ""
-	commandLoop := newCommandLoop(emulatorLoop, sdlLoop, cpuProfiling)
-	inputLoop := sms.NewInputLoop(emulatorLoop.sms)
+	commandLoop := newCommandLoop(emulatorLoop, sdlLoop, cpuProfiling, *border)
+	commandLoop.unthrottled = *unthrottledFlag
+	if *speed != 1 || *unthrottledFlag {
+		commandLoop.setSpeed(*speed)
+	}
+	inputLoop := sms.NewInputLoop(emulatorLoop.sms, config, sdlLoop)
+	if *glasses != "" {
+		composer, err := sms.NewGlasses(*glasses)
+		if err != nil {
+			log.Fatal(err)
+		}
+		commandLoop.glasses = composer
+	}
+	if *record != "" {
+		commandLoop.toggleRecording(*record)
+	}
+	if *recordMovie != "" {
+		if err := emulatorLoop.sms.RecordMovie(*recordMovie); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *playMovie != "" {
+		movie, err := sms.LoadMovie(*playMovie)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := emulatorLoop.sms.PlayMovie(movie); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *vgm != "" {
+		commandLoop.toggleVGMLog(*vgm)
+	}
 
 	application.Register("Emulator loop", emulatorLoop)
 	application.Register("Command loop", commandLoop)
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	sms "github.com/remogatto/sms/segamastersystem"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// runUsage shows the usage of the run subcommand.
+func runUsage(flags *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Run a game for a fixed number of frames without a window\n\n")
+		fmt.Fprintf(os.Stderr, "Usage:\n\n")
+		fmt.Fprintf(os.Stderr, "\tsms run [options] game.sms\n\n")
+		fmt.Fprintf(os.Stderr, "Options are:\n\n")
+		flags.PrintDefaults()
+	}
+}
+
+// parseFrameList parses a comma separated list of frame numbers.
+func parseFrameList(list string) (map[int]bool, error) {
+	frames := make(map[int]bool)
+	if list == "" {
+		return frames, nil
+	}
+	for _, field := range strings.Split(list, ",") {
+		frame, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid frame number %q", field)
+		}
+		frames[frame] = true
+	}
+	return frames, nil
+}
+
+// runHeadless implements the run subcommand. It emulates a game for
+// a fixed number of frames, optionally feeding it scripted input,
+// and logs the hash of every frame. Selected frames are saved as PNG
+// files in the dump directory.
+func runHeadless(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	numFrames := flags.Int("frames", 600, "number of frames to emulate")
+	dump := flags.String("dump", "", "directory where the hash log and PNG frames are written (default: hashes on stdout)")
+	pngList := flags.String("png", "", "comma separated list of frames to save as PNG (default: the last one)")
+	every := flags.Int("every", 0, "also save every n-th frame as PNG")
+	border := flags.Bool("border", false, "include the border in PNG frames and videos")
+	input := flags.String("input", "", "input script to play")
+	record := flags.String("record", "", "record a video (.gif or .y4m) of the run")
+	vgm := flags.String("vgm", "", "log the music of the run into a VGM file")
+	glasses := flags.String("glasses", "", "compose the PNG frames and videos of 3-D games as anaglyph, sidebyside, left or right eye frames")
+	movieFile := flags.String("movie", "", "play back a movie file instead of -frames frames, failing if it gets out of sync")
+	saveMovie := flags.String("savemovie", "", "record the input of the run into a movie file")
+	noSpriteLimit := flags.Bool("nospritelimit", false, "disable the limit of 8 sprites per line")
+	flags.Usage = runUsage(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("missing game")
+	}
+	pngFrames, err := parseFrameList(*pngList)
+	if err != nil {
+		return err
+	}
+
+	script := &sms.InputScript{}
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		script, err = sms.ReadInputScript(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", *input, err)
+		}
+	}
+
+	var hashLog io.Writer = os.Stdout
+	if *dump != "" {
+		if err := os.MkdirAll(*dump, 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(filepath.Join(*dump, "hashes.txt"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hashLog = f
+	}
+
+	console := sms.NewSMS()
+	console.SetSpriteLimit(!*noSpriteLimit)
+	console.LoadROM(flags.Arg(0))
+	if *vgm != "" {
+		if err := console.StartVGMLog(*vgm); err != nil {
+			return err
+		}
+	}
+
+	if *saveMovie != "" {
+		if err := console.RecordMovie(*saveMovie); err != nil {
+			return err
+		}
+	}
+	if *movieFile != "" {
+		movie, err := sms.LoadMovie(*movieFile)
+		if err != nil {
+			return err
+		}
+		if err := console.PlayMovie(movie); err != nil {
+			return err
+		}
+		*numFrames = movie.Frames
+	}
+	if len(pngFrames) == 0 && *every == 0 {
+		pngFrames[*numFrames] = true
+	}
+
+	var composer *sms.Glasses
+	if *glasses != "" {
+		if composer, err = sms.NewGlasses(*glasses); err != nil {
+			return err
+		}
+	}
+
+	var recorder sms.Recorder
+	if *record != "" {
+		if recorder, err = sms.NewRecorder(*record, *border); err != nil {
+			return err
+		}
+	}
+
+	for frame := 1; frame <= *numFrames; frame++ {
+		script.Apply(console, frame)
+		data := console.RenderFrame()
+		fmt.Fprintf(hashLog, "%d %s\n", frame, data.Hash())
+		if composer != nil {
+			composer.Compose(data)
+		}
+		if recorder != nil {
+			if err := recorder.WriteFrame(data); err != nil {
+				data.Release()
+				return err
+			}
+		}
+		if *dump != "" && (pngFrames[frame] || (*every > 0 && frame%*every == 0)) {
+			filename := filepath.Join(*dump, fmt.Sprintf("frame-%05d.png", frame))
+			if err := data.WritePNG(filename, *border); err != nil {
+				data.Release()
+				return err
+			}
+		}
+		data.Release()
+	}
+	if *vgm != "" {
+		if err := console.StopVGMLog(); err != nil {
+			return err
+		}
+	}
+	if *saveMovie != "" {
+		if err := console.StopMovie(); err != nil {
+			return err
+		}
+	}
+	if err := console.MovieError(); err != nil {
+		return err
+	}
+	if recorder != nil {
+		return recorder.Close()
+	}
+	return nil
+}
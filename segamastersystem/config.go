@@ -0,0 +1,238 @@
+package sms
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Hotkey actions which can be bound in the configuration.
+const (
+	HOTKEY_PAUSE         = "pause"
+	HOTKEY_DEBUG         = "debug"
+	HOTKEY_SCREENSHOT    = "screenshot"
+	HOTKEY_RECORD        = "record"
+	HOTKEY_VGM           = "vgm"
+	HOTKEY_VGM_LOOP      = "vgm-loop"
+	HOTKEY_QUIT          = "quit"
+	HOTKEY_REWIND        = "rewind"
+	HOTKEY_FAST_FORWARD  = "fast-forward"
+	HOTKEY_TURBO         = "turbo"
+	HOTKEY_SLOWER        = "slower"
+	HOTKEY_FASTER        = "faster"
+	HOTKEY_UNTHROTTLED   = "unthrottled"
+	HOTKEY_FRAME_ADVANCE = "frame-advance"
+)
+
+var hotkeyActions = []string{
+	HOTKEY_PAUSE,
+	HOTKEY_DEBUG,
+	HOTKEY_SCREENSHOT,
+	HOTKEY_RECORD,
+	HOTKEY_VGM,
+	HOTKEY_VGM_LOOP,
+	HOTKEY_QUIT,
+	HOTKEY_REWIND,
+	HOTKEY_FAST_FORWARD,
+	HOTKEY_TURBO,
+	HOTKEY_SLOWER,
+	HOTKEY_FASTER,
+	HOTKEY_UNTHROTTLED,
+	HOTKEY_FRAME_ADVANCE,
+}
+
+// gamepadInput matches the names of the gamepad inputs: buttons,
+// axis directions and hat directions.
+var gamepadInput = regexp.MustCompile(`^(button[0-9]+|axis[0-9]+[+-]|hat[0-9]+-(up|down|left|right))$`)
+
+// Config contains the key bindings of the emulator. Each keyboard
+// section maps a button or an action to the name of a key, as
+// returned by sdl.GetKeyName. The gamepad section maps the inputs of
+// a gamepad to joypad buttons and applies to the pads of both
+// players.
+type Config struct {
+	Joypad1 map[string]string `json:"joypad1"`
+	Joypad2 map[string]string `json:"joypad2"`
+	Console map[string]string `json:"console"`
+	Hotkeys map[string]string `json:"hotkeys"`
+	Gamepad map[string]string `json:"gamepad"`
+}
+
+// DefaultConfig returns the default key bindings.
+func DefaultConfig() *Config {
+	return &Config{
+		Joypad1: map[string]string{
+			"up":    "up",
+			"down":  "down",
+			"left":  "left",
+			"right": "right",
+			"fire1": "z",
+			"fire2": "x",
+		},
+		Joypad2: map[string]string{
+			"up":    "i",
+			"down":  "k",
+			"left":  "j",
+			"right": "l",
+			"fire1": "n",
+			"fire2": "m",
+		},
+		Console: map[string]string{
+			"reset": "r",
+		},
+		Hotkeys: map[string]string{
+			HOTKEY_PAUSE:         "p",
+			HOTKEY_DEBUG:         "d",
+			HOTKEY_SCREENSHOT:    "f12",
+			HOTKEY_RECORD:        "f11",
+			HOTKEY_VGM:           "f10",
+			HOTKEY_VGM_LOOP:      "f9",
+			HOTKEY_QUIT:          "escape",
+			HOTKEY_REWIND:        "backspace",
+			HOTKEY_FAST_FORWARD:  "tab",
+			HOTKEY_TURBO:         "t",
+			HOTKEY_SLOWER:        "-",
+			HOTKEY_FASTER:        "=",
+			HOTKEY_UNTHROTTLED:   "u",
+			HOTKEY_FRAME_ADVANCE: "f",
+		},
+		Gamepad: map[string]string{
+			"axis0-":     "left",
+			"axis0+":     "right",
+			"axis1-":     "up",
+			"axis1+":     "down",
+			"hat0-up":    "up",
+			"hat0-down":  "down",
+			"hat0-left":  "left",
+			"hat0-right": "right",
+			"button0":    "fire1",
+			"button1":    "fire2",
+		},
+	}
+}
+
+// DefaultConfigPath returns the path of the configuration file in
+// the user's configuration directory.
+func DefaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sms", "config.json")
+}
+
+// Load reads the JSON configuration file at path. The bindings found
+// in the file override the current ones, the others are left as
+// they are.
+func (config *Config) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(config); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// validate checks that all the bound buttons and actions exist, and
+// that no key is bound to two hotkeys or to a hotkey and a button.
+func (config *Config) validate() error {
+	for _, joypad := range []map[string]string{config.Joypad1, config.Joypad2} {
+		for button := range joypad {
+			if _, ok := buttonNames[button]; !ok {
+				return fmt.Errorf("unknown joypad button %q", button)
+			}
+		}
+	}
+	for input, button := range config.Gamepad {
+		if !gamepadInput.MatchString(input) {
+			return fmt.Errorf("unknown gamepad input %q", input)
+		}
+		if _, ok := buttonNames[button]; !ok {
+			return fmt.Errorf("unknown joypad button %q", button)
+		}
+	}
+	for button := range config.Console {
+		if button != "reset" {
+			return fmt.Errorf("unknown console button %q", button)
+		}
+	}
+	for action := range config.Hotkeys {
+		if !isHotkeyAction(action) {
+			return fmt.Errorf("unknown hotkey action %q", action)
+		}
+	}
+	hotkeys := make(map[string]string)
+	for _, action := range hotkeyActions {
+		key, ok := config.Hotkeys[action]
+		if !ok {
+			continue
+		}
+		if other, ok := hotkeys[key]; ok {
+			return fmt.Errorf("key %q bound to both the %s and %s hotkeys", key, other, action)
+		}
+		hotkeys[key] = action
+	}
+	for section, buttons := range map[string]map[string]string{
+		"joypad1": config.Joypad1,
+		"joypad2": config.Joypad2,
+		"console": config.Console,
+	} {
+		for button, key := range buttons {
+			if action, ok := hotkeys[key]; ok {
+				return fmt.Errorf("key %q bound to both the %s hotkey and %s %s", key, action, section, button)
+			}
+		}
+	}
+	return nil
+}
+
+func isHotkeyAction(action string) bool {
+	for _, a := range hotkeyActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// keyMap returns the joypad bits bound to each key.
+func (config *Config) keyMap() map[string]int {
+	keyMap := make(map[string]int)
+	for button, key := range config.Joypad1 {
+		keyMap[key] |= JoypadValue(1, buttonNames[button])
+	}
+	for button, key := range config.Joypad2 {
+		keyMap[key] |= JoypadValue(2, buttonNames[button])
+	}
+	for _, key := range config.Console {
+		keyMap[key] |= RESET_BUTTON
+	}
+	return keyMap
+}
+
+// gamepadMap returns the player-independent buttons bound to each
+// gamepad input.
+func (config *Config) gamepadMap() map[string]int {
+	gamepadMap := make(map[string]int)
+	for input, button := range config.Gamepad {
+		gamepadMap[input] |= buttonNames[button]
+	}
+	return gamepadMap
+}
+
+// hotkeyMap returns the action bound to each key.
+func (config *Config) hotkeyMap() map[string]string {
+	hotkeyMap := make(map[string]string)
+	for action, key := range config.Hotkeys {
+		hotkeyMap[key] = action
+	}
+	return hotkeyMap
+}
@@ -0,0 +1,216 @@
+package sms
+
+import (
+	"fmt"
+	"github.com/remogatto/application"
+)
+
+// Devices which can be plugged into the controller ports by name.
+const (
+	DEVICE_JOYPAD    = "joypad"
+	DEVICE_PHASER    = "phaser"
+	DEVICE_PADDLE    = "paddle"
+	DEVICE_SPORTSPAD = "sportspad"
+)
+
+// Mouse buttons, as reported by CmdMouse.
+const (
+	MOUSE_LEFT = 1 << iota
+	MOUSE_RIGHT
+)
+
+// Uses of the mouse by the controllers, as replied to CmdMouseDevices.
+const (
+	MOUSE_AIM    = 1 << iota // A Light Phaser follows the mouse position
+	MOUSE_MOTION             // Paddles or Sports Pads follow the mouse motion
+)
+
+// PortOutput is the direction and the output level of the TH and TR
+// lines of a controller port, as set by port 0x3f.
+type PortOutput struct {
+	TH, TR           bool // Set as outputs by the console
+	THLevel, TRLevel bool
+}
+
+// ControllerPort is a device plugged into one of the two controller
+// ports.
+type ControllerPort interface {
+	// Read returns the data lines up, down, left, right, TL and TR
+	// in bits 0-5 and TH in bit 6, low when asserted. strobe is true
+	// when the console reads the I/O port holding the TR line of the
+	// controller port.
+	Read(strobe bool) byte
+
+	// Write is called when the console changes the direction or the
+	// output level of the TH and TR lines.
+	Write(output PortOutput)
+
+	// Update is called at the end of each frame.
+	Update()
+}
+
+// mouseDevice is a controller driven by the motion of the mouse.
+type mouseDevice interface {
+	mouse(dx, dy, buttons int)
+}
+
+// joypad is the standard control pad.
+type joypad struct {
+	buttons int // Player-independent buttons held
+}
+
+func (j *joypad) Read(strobe bool) byte {
+	return byte(0x7f &^ j.buttons)
+}
+
+func (j *joypad) Write(output PortOutput) {}
+
+func (j *joypad) Update() {}
+
+// Plug plugs a device into controller port 1 or 2.
+func (sms *SMS) Plug(port int, device ControllerPort) {
+	if sms.controllers[port-1] == sms.vdp.phaser {
+		sms.vdp.phaser = nil
+	}
+	if phaser, ok := device.(*lightPhaser); ok {
+		sms.vdp.phaser = phaser
+	}
+	sms.controllers[port-1] = device
+	device.Write(sms.portOutput(port))
+}
+
+// Connect plugs a device, given by name, into controller port 1 or 2.
+// Only one Light Phaser can be connected at a time, since the VDP
+// latches the H counter for a single one.
+func (sms *SMS) Connect(port int, device string) error {
+	if port != 1 && port != 2 {
+		return fmt.Errorf("no controller port %d", port)
+	}
+	switch device {
+	case DEVICE_JOYPAD:
+		sms.Plug(port, &joypad{})
+	case DEVICE_PHASER:
+		if _, ok := sms.controllers[2-port].(*lightPhaser); ok {
+			return fmt.Errorf("a Light Phaser is already connected to port %d", 3-port)
+		}
+		sms.Plug(port, &lightPhaser{x: -1, y: -1})
+	case DEVICE_PADDLE:
+		sms.Plug(port, &paddle{position: 0x80})
+	case DEVICE_SPORTSPAD:
+		sms.Plug(port, &sportsPad{th: true})
+	default:
+		return fmt.Errorf("unknown controller %q", device)
+	}
+	return nil
+}
+
+// Joypad presses or releases the buttons given by value, laid out as
+// the JOYPAD1_* and JOYPAD2_* constants, of the joypads plugged into
+// the controller ports, as well as the reset button.
+func (sms *SMS) Joypad(value int, event byte) {
+	if sms.movie != nil && !sms.movieEvent(value, event) {
+		return
+	}
+	sms.joypad(value, event)
+}
+
+func (sms *SMS) joypad(value int, event byte) {
+	if event != JOYPAD_DOWN && event != JOYPAD_UP {
+		application.Logf("%s", "Unknown joypad event")
+		return
+	}
+	for i, controller := range sms.controllers {
+		if pad, ok := controller.(*joypad); ok {
+			buttons := (value >> uint(6*i)) & 0x3f
+			if event == JOYPAD_DOWN {
+				pad.buttons |= buttons
+			} else {
+				pad.buttons &^= buttons
+			}
+		}
+	}
+	if value&RESET_BUTTON != 0 {
+		sms.reset = event == JOYPAD_DOWN
+	}
+}
+
+// Mouse reports the relative motion of the mouse and the buttons
+// held to the controllers driven by the mouse.
+func (sms *SMS) Mouse(dx, dy, buttons int) {
+	for _, controller := range sms.controllers {
+		if device, ok := controller.(mouseDevice); ok {
+			device.mouse(dx, dy, buttons)
+		}
+	}
+}
+
+// MouseDevices returns the MOUSE_AIM and MOUSE_MOTION flags of the
+// controllers plugged in.
+func (sms *SMS) MouseDevices() int {
+	devices := 0
+	for _, controller := range sms.controllers {
+		if _, ok := controller.(*lightPhaser); ok {
+			devices |= MOUSE_AIM
+		}
+		if _, ok := controller.(mouseDevice); ok {
+			devices |= MOUSE_MOTION
+		}
+	}
+	return devices
+}
+
+// updateControllers is called at the end of each frame.
+func (sms *SMS) updateControllers() {
+	for _, controller := range sms.controllers {
+		controller.Update()
+	}
+}
+
+// portOutput returns the state of the TH and TR lines of controller
+// port 1 or 2 as last set by port 0x3f.
+func (sms *SMS) portOutput(port int) PortOutput {
+	control := sms.ioControl >> uint(2*(port-1))
+	return PortOutput{
+		TR:      (control & 0x01) == 0,
+		TH:      (control & 0x02) == 0,
+		TRLevel: (control & 0x10) != 0,
+		THLevel: (control & 0x20) != 0,
+	}
+}
+
+// portLines returns the lines of controller port 1 or 2, laid out as
+// by ControllerPort.Read. Nationalisation, pretend we're British: TH
+// lines set as outputs read back their level.
+func (sms *SMS) portLines(port int, strobe bool) byte {
+	lines := sms.controllers[port-1].Read(strobe)
+	if output := sms.portOutput(port); output.TH && !output.THLevel {
+		lines &^= 0x40
+	}
+	return lines
+}
+
+// readPortDC returns the lines of port A and up and down of port B.
+func (sms *SMS) readPortDC() byte {
+	a, b := sms.portLines(1, true), sms.portLines(2, false)
+	return a&0x3f | b<<6
+}
+
+// readPortDD returns the remaining lines of port B, the reset button
+// and the TH lines.
+func (sms *SMS) readPortDD() byte {
+	a, b := sms.portLines(1, false), sms.portLines(2, true)
+	value := (b>>2)&0x0f | 0x30 | a&0x40 | (b&0x40)<<1
+	if sms.reset {
+		value &^= 0x10
+	}
+	return value
+}
+
+// writeIOControl sets the direction and the output level of the TH
+// and TR lines of both controller ports.
+func (sms *SMS) writeIOControl(b byte) {
+	sms.ioControl = b
+	for i, controller := range sms.controllers {
+		controller.Write(sms.portOutput(i + 1))
+	}
+}
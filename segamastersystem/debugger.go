@@ -0,0 +1,335 @@
+package sms
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/remogatto/z80"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEBUGGER_HISTORY     = 4  // Executed instructions shown before the current one
+	DEBUGGER_DISASSEMBLE = 8  // Instructions shown from the current one
+	DEBUGGER_DUMP        = 64 // Bytes shown by the mem command
+)
+
+// How the debugger lets the emulation run.
+const (
+	DEBUG_RUN   = iota // Until a breakpoint
+	DEBUG_STEP         // A number of instructions
+	DEBUG_LINE         // Until the next line
+	DEBUG_FRAME        // Until the next frame
+)
+
+const debuggerHelp = `Commands:
+  s, step [n]        execute n instructions (default 1)
+  l, line            run until the next line
+  f, frame           run until the next frame
+  c, continue        run until a breakpoint
+  b, break [addr]    set a breakpoint, or list them
+  d, delete addr     delete a breakpoint
+  w, watch [spec]    set a watchpoint, or list them
+  unwatch n          delete the n-th watchpoint
+  r, regs            show the registers
+  u, disasm [addr]   disassemble from addr (default: around PC)
+  m, mem addr [n]    dump n bytes of memory
+  h, help            show this help
+Addresses are hexadecimal. An empty line repeats the last command.
+Watchpoints have the form [port] addr [r|w|rw] [=value|changed] [log],
+watching writes by default. With log, accesses are logged with their
+PC and cycle instead of stopping the emulation.
+`
+
+// Debugger is a console debugger. Once attached to the machine it is
+// checked before each instruction, and reads commands from its input
+// whenever the emulation stops at a breakpoint or after a step.
+type Debugger struct {
+	in          *bufio.Scanner
+	out         io.Writer
+	breakpoints map[uint16]bool
+	mode        int
+	steps       int    // Instructions left to step
+	line        uint16 // Where a line step started
+	frame       int    // Where a frame step started
+	history     [DEBUGGER_HISTORY]uint16
+	executed    int // Instructions recorded into history
+	lastCommand string
+	watchpoints []*Watchpoint
+	watchHit    string // Access which stops the emulation after the current instruction
+	sms         *SMS
+}
+
+// NewDebugger returns a debugger reading commands from in and writing
+// to out.
+func NewDebugger(in io.Reader, out io.Writer) *Debugger {
+	return &Debugger{
+		in:          bufio.NewScanner(in),
+		out:         out,
+		breakpoints: make(map[uint16]bool),
+	}
+}
+
+// SetBreakpoint stops the emulation before the instruction at
+// address is executed.
+func (d *Debugger) SetBreakpoint(address uint16) {
+	d.breakpoints[address] = true
+}
+
+// AttachDebugger checks the debugger before each instruction.
+func (sms *SMS) AttachDebugger(d *Debugger) {
+	sms.debugger = d
+	sms.memory.debugger = d
+	d.sms = sms
+}
+
+// Debugging returns whether a debugger is attached.
+func (sms *SMS) Debugging() bool {
+	return sms.debugger != nil
+}
+
+// Debug reads debugger commands at the current instruction, until
+// the emulation is let run again.
+func (sms *SMS) Debug() {
+	sms.debugger.stop(sms, "Stopped")
+}
+
+// Disassemble returns num instructions from the program counter.
+func (sms *SMS) Disassemble(num int) []z80.DebugInstruction {
+	return z80.DisassembleN(memoryPeeker{sms.memory}, sms.cpu.PC(), num)
+}
+
+// memoryPeeker reads the memory for the debugger, without setting off
+// the watchpoints.
+type memoryPeeker struct {
+	memory *Memory
+}
+
+func (p memoryPeeker) ReadByte(address uint16) byte {
+	return p.memory.ReadByteInternal(address)
+}
+
+// instruction is called before each instruction is executed.
+func (d *Debugger) instruction(sms *SMS) {
+	pc := sms.cpu.PC()
+	if reason := d.check(sms, pc); reason != "" {
+		d.stop(sms, reason)
+	}
+	d.history[d.executed%DEBUGGER_HISTORY] = pc
+	d.executed++
+}
+
+// check returns why the emulation stops before the instruction at
+// pc, or an empty string.
+func (d *Debugger) check(sms *SMS, pc uint16) string {
+	if d.watchHit != "" {
+		fmt.Fprintln(d.out, d.watchHit)
+		d.watchHit = ""
+		return "Watchpoint"
+	}
+	switch d.mode {
+	case DEBUG_STEP:
+		if d.steps--; d.steps <= 0 {
+			return "Step"
+		}
+	case DEBUG_LINE:
+		if sms.vdp.currentLine != d.line {
+			return "Line"
+		}
+	case DEBUG_FRAME:
+		if sms.frame != d.frame {
+			return "Frame"
+		}
+	}
+	if d.breakpoints[pc] {
+		return "Breakpoint"
+	}
+	return ""
+}
+
+// stop shows where the emulation stopped and runs commands until one
+// of them lets it run again.
+func (d *Debugger) stop(sms *SMS, reason string) {
+	d.mode = DEBUG_RUN
+	fmt.Fprintf(d.out, "%s at 0x%04x (frame %d, line %d)\n", reason, sms.cpu.PC(), sms.frame, sms.vdp.currentLine)
+	d.disassemble(sms, sms.cpu.PC(), 1)
+	for {
+		fmt.Fprint(d.out, "(sms) ")
+		if !d.in.Scan() {
+			// Without input, let the emulation run
+			fmt.Fprintln(d.out)
+			return
+		}
+		command := strings.TrimSpace(d.in.Text())
+		if command == "" {
+			command = d.lastCommand
+		}
+		d.lastCommand = command
+		if d.run(sms, strings.Fields(command)) {
+			return
+		}
+	}
+}
+
+// run executes a command, returning true if the emulation runs again.
+func (d *Debugger) run(sms *SMS, args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	var err error
+	switch args[0] {
+	case "s", "step":
+		d.steps = 1
+		if len(args) > 1 {
+			d.steps, err = strconv.Atoi(args[1])
+		}
+		if err == nil && d.steps > 0 {
+			d.mode = DEBUG_STEP
+			return true
+		}
+	case "l", "line":
+		d.mode, d.line = DEBUG_LINE, sms.vdp.currentLine
+		return true
+	case "f", "frame":
+		d.mode, d.frame = DEBUG_FRAME, sms.frame
+		return true
+	case "c", "continue":
+		return true
+	case "b", "break":
+		if len(args) == 1 {
+			d.listBreakpoints()
+			return false
+		}
+		var address uint16
+		if address, err = ParseAddress(args[1]); err == nil {
+			d.SetBreakpoint(address)
+		}
+	case "d", "delete":
+		var address uint16
+		if len(args) < 2 {
+			err = fmt.Errorf("missing address")
+		} else if address, err = ParseAddress(args[1]); err == nil {
+			delete(d.breakpoints, address)
+		}
+	case "w", "watch":
+		if len(args) == 1 {
+			for i, w := range d.watchpoints {
+				fmt.Fprintf(d.out, "%d: %s\n", i+1, w)
+			}
+			return false
+		}
+		var w *Watchpoint
+		if w, err = ParseWatchpoint(strings.Join(args[1:], " ")); err == nil {
+			d.Watch(w)
+		}
+	case "unwatch":
+		n := 0
+		if len(args) > 1 {
+			n, _ = strconv.Atoi(args[1])
+		}
+		if n < 1 || n > len(d.watchpoints) {
+			err = fmt.Errorf("no such watchpoint")
+		} else {
+			d.watchpoints = append(d.watchpoints[:n-1], d.watchpoints[n:]...)
+		}
+	case "r", "regs":
+		d.registers(sms)
+	case "u", "disasm":
+		if len(args) == 1 {
+			d.around(sms)
+			return false
+		}
+		var address uint16
+		if address, err = ParseAddress(args[1]); err == nil {
+			d.disassemble(sms, address, DEBUGGER_DISASSEMBLE)
+		}
+	case "m", "mem":
+		err = d.dump(sms, args[1:])
+	case "h", "help":
+		fmt.Fprint(d.out, debuggerHelp)
+	default:
+		err = fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(d.out, "%s\n", err)
+	}
+	return false
+}
+
+// ParseAddress parses a hexadecimal address, with an optional 0x or
+// $ prefix.
+func ParseAddress(s string) (uint16, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "0x"), "$")
+	address, err := strconv.ParseUint(s, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q", s)
+	}
+	return uint16(address), nil
+}
+
+func (d *Debugger) listBreakpoints() {
+	addresses := make([]int, 0, len(d.breakpoints))
+	for address := range d.breakpoints {
+		addresses = append(addresses, int(address))
+	}
+	sort.Ints(addresses)
+	for _, address := range addresses {
+		fmt.Fprintf(d.out, "0x%04x\n", address)
+	}
+}
+
+func (d *Debugger) registers(sms *SMS) {
+	cpu := sms.cpu
+	fmt.Fprintf(d.out, "AF=%02x%02x BC=%02x%02x DE=%02x%02x HL=%02x%02x IX=%02x%02x IY=%02x%02x SP=%04x PC=%04x\n",
+		cpu.A, cpu.F, cpu.B, cpu.C, cpu.D, cpu.E, cpu.H, cpu.L, cpu.IXH, cpu.IXL, cpu.IYH, cpu.IYL, cpu.SP(), cpu.PC())
+	fmt.Fprintf(d.out, "AF'=%02x%02x BC'=%02x%02x DE'=%02x%02x HL'=%02x%02x I=%02x R=%02x IM=%d IFF1=%d IFF2=%d\n",
+		cpu.A_, cpu.F_, cpu.B_, cpu.C_, cpu.D_, cpu.E_, cpu.H_, cpu.L_, cpu.I, byte(cpu.R&0x7f)|cpu.R7&0x80, cpu.IM, cpu.IFF1, cpu.IFF2)
+	fmt.Fprintf(d.out, "Halted=%t Cycles=%d\n", cpu.Halted, sms.Cycles())
+}
+
+// around disassembles the last instructions executed and those
+// following the current one.
+func (d *Debugger) around(sms *SMS) {
+	for i := DEBUGGER_HISTORY; i > 0; i-- {
+		if d.executed >= i {
+			d.disassemble(sms, d.history[(d.executed-i)%DEBUGGER_HISTORY], 1)
+		}
+	}
+	d.disassemble(sms, sms.cpu.PC(), DEBUGGER_DISASSEMBLE)
+}
+
+func (d *Debugger) disassemble(sms *SMS, address uint16, num int) {
+	for _, instr := range z80.DisassembleN(memoryPeeker{sms.memory}, address, num) {
+		arrow := ""
+		if instr.Address == sms.cpu.PC() {
+			arrow = "=>>"
+		}
+		fmt.Fprintf(d.out, "%s\t0x%04x %s\n", arrow, instr.Address, instr.Mnemonic)
+	}
+}
+
+func (d *Debugger) dump(sms *SMS, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing address")
+	}
+	address, err := ParseAddress(args[0])
+	if err != nil {
+		return err
+	}
+	n := DEBUGGER_DUMP
+	if len(args) > 1 {
+		if n, err = strconv.Atoi(args[1]); err != nil {
+			return fmt.Errorf("invalid count %q", args[1])
+		}
+	}
+	for i := 0; i < n; i += 16 {
+		fmt.Fprintf(d.out, "0x%04x:", address+uint16(i))
+		for j := i; j < i+16 && j < n; j++ {
+			fmt.Fprintf(d.out, " %02x", sms.memory.ReadByteInternal(address+uint16(j)))
+		}
+		fmt.Fprintln(d.out)
+	}
+	return nil
+}
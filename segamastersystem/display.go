@@ -1,26 +1,137 @@
 package sms
 
+import (
+	"crypto/sha1"
+	"fmt"
+)
+
 const (
 	DISPLAY_WIDTH      = 256
 	DISPLAY_HEIGHT     = 192
+	DISPLAY_HEIGHT_224 = 224
+	DISPLAY_HEIGHT_240 = 240
+	DISPLAY_MAX_HEIGHT = DISPLAY_HEIGHT_240
 	DISPLAY_WIDTH_LOG2 = 8
-	DISPLAY_SIZE       = DISPLAY_WIDTH * DISPLAY_HEIGHT
+	DISPLAY_SIZE       = DISPLAY_WIDTH * DISPLAY_MAX_HEIGHT
 	BORDER_LEFT_RIGHT  = 64
 	BORDER_TOP_BOTTOM  = 48
 	SCREEN_WIDTH       = DISPLAY_WIDTH + BORDER_LEFT_RIGHT*2
 	SCREEN_HEIGHT      = DISPLAY_HEIGHT + BORDER_TOP_BOTTOM*2
+	FRAME_POOL_SIZE    = 3
 )
 
-type DisplayData [DISPLAY_WIDTH * DISPLAY_HEIGHT]byte
+// DisplayData contains the palette indexes of a rendered frame. Only
+// the first Height lines of Pixels belong to the active display.
+// Palette and Border hold, for each line, the contents of CRAM and
+// the border palette index at the time the line was rasterized, so
+// that mid-frame palette changes show up on the right lines. Only
+// the first 32 palette entries are taken from CRAM, the others are
+// used by the frames composed for the 3-D glasses. Eye tells which
+// eye the frame is shown to through the glasses.
+type DisplayData struct {
+	Pixels  [DISPLAY_SIZE]byte
+	Palette [DISPLAY_MAX_HEIGHT][64]byte
+	Border  [DISPLAY_MAX_HEIGHT]byte
+	Height  int
+	Eye     int
+	pool    *FramePool
+	inUse   bool
+}
+
+// Color returns the color (in the --bbggrr format of CRAM) of the
+// pixel at (x, y) of the active display.
+func (data *DisplayData) Color(x, y int) byte {
+	return data.Palette[y][data.Pixels[y<<DISPLAY_WIDTH_LOG2+x]] & 0x3f
+}
+
+// BorderColor returns the color of the border on the screen row y,
+// counting from the top of the screen. Rows above and below the
+// active display take the color of the nearest line.
+func (data *DisplayData) BorderColor(y int) byte {
+	line := y - data.BorderTop()
+	if line < 0 {
+		line = 0
+	} else if line >= data.Height {
+		line = data.Height - 1
+	}
+	return data.Palette[line][data.Border[line]] & 0x3f
+}
+
+// Release gives the frame back to the pool it was obtained from.
+// The frame must not be accessed after it has been released.
+func (data *DisplayData) Release() {
+	if data.pool != nil {
+		data.pool.Put(data)
+	}
+}
+
+// BorderTop returns the number of border lines shown above the
+// active display, so that frames of any height are vertically
+// centered on the screen.
+func (data *DisplayData) BorderTop() int {
+	return (SCREEN_HEIGHT - data.Height) / 2
+}
+
+// Hash returns a SHA-1 digest of the active display along with the
+// palette and border of each line.
+func (data *DisplayData) Hash() string {
+	h := sha1.New()
+	h.Write(data.Pixels[:DISPLAY_WIDTH*data.Height])
+	for line := 0; line < data.Height; line++ {
+		h.Write(data.Palette[line][:32])
+	}
+	h.Write(data.Border[:data.Height])
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// FramePool hands out a fixed set of frame buffers. A frame obtained
+// from Get is owned by the caller until it is released, so the
+// emulator never rasterizes into a frame that is still being
+// displayed.
+type FramePool struct {
+	frames []*DisplayData
+	free   chan *DisplayData
+}
+
+// NewFramePool returns a pool of size frames.
+func NewFramePool(size int) *FramePool {
+	pool := &FramePool{
+		frames: make([]*DisplayData, size),
+		free:   make(chan *DisplayData, size),
+	}
+	for i := range pool.frames {
+		pool.frames[i] = &DisplayData{Height: DISPLAY_HEIGHT, pool: pool}
+		pool.free <- pool.frames[i]
+	}
+	return pool
+}
+
+// Get returns a free frame, waiting for one to be released if all
+// of them are in use.
+func (pool *FramePool) Get() *DisplayData {
+	data := <-pool.free
+	data.inUse = true
+	return data
+}
 
-type PaletteValue struct {
-	index   byte
-	r, g, b byte
+// Put gives a frame back to the pool. Frames which don't belong to
+// the pool, such as copies, are ignored.
+func (pool *FramePool) Put(data *DisplayData) {
+	for _, frame := range pool.frames {
+		if frame == data {
+			if !data.inUse {
+				panic("frame released twice")
+			}
+			data.inUse = false
+			pool.free <- data
+			return
+		}
+	}
 }
 
-// Interface for rendering backend
+// Interface for rendering backend. Frames sent to the Display
+// channel are owned by the backend, which must release them once
+// they have been rendered.
 type DisplayLoop interface {
 	Display() chan<- *DisplayData
-	WritePalette() chan<- PaletteValue
-	UpdateBorder() chan<- byte
 }
@@ -0,0 +1,163 @@
+package sms
+
+import (
+	"fmt"
+	"github.com/remogatto/application"
+	"github.com/scottferg/Go-SDL/sdl"
+	"time"
+)
+
+const (
+	// Axis deflection past which the bound direction is pressed
+	GAMEPAD_AXIS_THRESHOLD = 16384
+
+	// One gamepad per player
+	GAMEPAD_PLAYERS = 2
+
+	// How often to look for plugged or unplugged gamepads
+	GAMEPAD_RESCAN_INTERVAL = 3 * time.Second
+)
+
+// gamepad holds the state of the pad of one player.
+type gamepad struct {
+	joystick *sdl.Joystick
+	name     string
+	inputs   map[string]bool
+	buttons  int
+}
+
+// gamepads drives the joypads from SDL joysticks: the first joystick
+// belongs to player 1, the second to player 2. The joysticks are
+// enumerated again every GAMEPAD_RESCAN_INTERVAL to follow the pads
+// plugged in and out. This needs an SDL which keeps its joystick list
+// up to date, like sdl12-compat: the original SDL 1.2 only enumerates
+// joysticks when initialized.
+type gamepads struct {
+	sms      *SMS
+	bindings map[string]int
+	pads     [GAMEPAD_PLAYERS]gamepad
+}
+
+func newGamepads(sms *SMS, bindings map[string]int) *gamepads {
+	g := &gamepads{sms: sms, bindings: bindings}
+	sdl.JoystickEventState(sdl.ENABLE)
+	g.open()
+	return g
+}
+
+// open opens the available joysticks.
+func (g *gamepads) open() {
+	for i := 0; i < sdl.NumJoysticks() && i < GAMEPAD_PLAYERS; i++ {
+		g.openPad(i)
+	}
+}
+
+// openPad opens the i-th joystick and reads its state.
+func (g *gamepads) openPad(i int) {
+	pad := &g.pads[i]
+	pad.name = sdl.JoystickName(i)
+	joystick := sdl.JoystickOpen(i)
+	if joystick == nil {
+		application.Logf("Can't open joystick %d: %s", i, sdl.GetError())
+		return
+	}
+	application.Logf("Player %d gamepad: %s", i+1, pad.name)
+	pad.joystick = joystick
+	pad.inputs = make(map[string]bool)
+	for axis := 0; axis < joystick.NumAxes(); axis++ {
+		pad.setAxis(axis, joystick.GetAxis(axis))
+	}
+	for hat := 0; hat < joystick.NumHats(); hat++ {
+		pad.setHat(hat, joystick.GetHat(hat))
+	}
+	for button := 0; button < joystick.NumButtons(); button++ {
+		pad.inputs[fmt.Sprintf("button%d", button)] = joystick.GetButton(button) != 0
+	}
+}
+
+// rescan enumerates the joysticks again, reopening the pads of the
+// players whose joystick changed. The buttons held on an unplugged
+// pad are released. It runs in the input loop, between the events:
+// unlike restarting the joystick subsystem, enumerating doesn't
+// disturb the polling of the events.
+func (g *gamepads) rescan() {
+	n := sdl.NumJoysticks()
+	for i := range g.pads {
+		pad := &g.pads[i]
+		name := ""
+		if i < n {
+			name = sdl.JoystickName(i)
+		}
+		if name == pad.name {
+			continue
+		}
+		if pad.joystick != nil {
+			pad.joystick.Close()
+			application.Logf("Player %d gamepad disconnected", i+1)
+		}
+		pad.joystick, pad.inputs, pad.name = nil, nil, ""
+		if i < n {
+			g.openPad(i)
+		}
+		g.update(i)
+	}
+}
+
+// event handles an SDL joystick event.
+func (g *gamepads) event(event interface{}) {
+	switch e := event.(type) {
+	case sdl.JoyAxisEvent:
+		if pad := g.pad(e.Which); pad != nil {
+			pad.setAxis(int(e.Axis), e.Value)
+			g.update(int(e.Which))
+		}
+	case sdl.JoyHatEvent:
+		if pad := g.pad(e.Which); pad != nil {
+			pad.setHat(int(e.Hat), e.Value)
+			g.update(int(e.Which))
+		}
+	case sdl.JoyButtonEvent:
+		if pad := g.pad(e.Which); pad != nil {
+			pad.inputs[fmt.Sprintf("button%d", e.Button)] = e.State == sdl.PRESSED
+			g.update(int(e.Which))
+		}
+	}
+}
+
+func (g *gamepads) pad(which uint8) *gamepad {
+	if int(which) >= GAMEPAD_PLAYERS || g.pads[which].joystick == nil {
+		return nil
+	}
+	return &g.pads[which]
+}
+
+// update presses and releases the joypad buttons of a player
+// according to the inputs held on its gamepad.
+func (g *gamepads) update(i int) {
+	pad := &g.pads[i]
+	buttons := 0
+	for input, held := range pad.inputs {
+		if held {
+			buttons |= g.bindings[input]
+		}
+	}
+	if released := pad.buttons &^ buttons; released != 0 {
+		g.sms.Command <- CmdJoypadEvent{JoypadValue(i+1, released), JOYPAD_UP}
+	}
+	if pressed := buttons &^ pad.buttons; pressed != 0 {
+		g.sms.Command <- CmdJoypadEvent{JoypadValue(i+1, pressed), JOYPAD_DOWN}
+	}
+	pad.buttons = buttons
+}
+
+func (pad *gamepad) setAxis(axis int, value int16) {
+	pad.inputs[fmt.Sprintf("axis%d-", axis)] = value < -GAMEPAD_AXIS_THRESHOLD
+	pad.inputs[fmt.Sprintf("axis%d+", axis)] = value > GAMEPAD_AXIS_THRESHOLD
+}
+
+func (pad *gamepad) setHat(hat int, value uint8) {
+	pad.inputs[fmt.Sprintf("hat%d-up", hat)] = value&sdl.HAT_UP != 0
+	pad.inputs[fmt.Sprintf("hat%d-down", hat)] = value&sdl.HAT_DOWN != 0
+	pad.inputs[fmt.Sprintf("hat%d-left", hat)] = value&sdl.HAT_LEFT != 0
+	pad.inputs[fmt.Sprintf("hat%d-right", hat)] = value&sdl.HAT_RIGHT != 0
+}
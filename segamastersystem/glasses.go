@@ -0,0 +1,98 @@
+package sms
+
+import (
+	"fmt"
+)
+
+// Eyes a frame is shown to through the 3-D glasses.
+const (
+	EYE_BOTH = iota // The game doesn't use the glasses
+	EYE_LEFT
+	EYE_RIGHT
+)
+
+// Output modes of the 3-D glasses.
+const (
+	GLASSES_ANAGLYPH     = "anaglyph"   // Red/cyan anaglyph
+	GLASSES_SIDE_BY_SIDE = "sidebyside" // Half-width left and right eye frames
+	GLASSES_LEFT         = "left"       // Left eye only
+	GLASSES_RIGHT        = "right"      // Right eye only
+)
+
+// identityPalette maps each palette index to the color of the same
+// value, so that composed frames can use any of the 64 colors.
+var identityPalette [64]byte
+
+func init() {
+	for i := range identityPalette {
+		identityPalette[i] = byte(i)
+	}
+}
+
+// Glasses composes the frames rendered for the left and right eyes
+// of the 3-D glasses into frames which can be watched without them.
+type Glasses struct {
+	mode        string
+	left, right DisplayData // Last frame shown to each eye
+}
+
+// NewGlasses returns a composer for the given output mode.
+func NewGlasses(mode string) (*Glasses, error) {
+	switch mode {
+	case GLASSES_ANAGLYPH, GLASSES_SIDE_BY_SIDE, GLASSES_LEFT, GLASSES_RIGHT:
+		return &Glasses{mode: mode}, nil
+	}
+	return nil, fmt.Errorf("unknown 3-D glasses mode %q", mode)
+}
+
+// Compose replaces, in place, a frame shown to one eye with the
+// composition of the last frames shown to each eye. Frames of games
+// which don't use the glasses are left untouched.
+func (g *Glasses) Compose(frame *DisplayData) {
+	switch frame.Eye {
+	case EYE_LEFT:
+		g.left = *frame
+	case EYE_RIGHT:
+		g.right = *frame
+	default:
+		return
+	}
+	left, right := &g.left, &g.right
+	if left.Height != frame.Height {
+		left = frame
+	}
+	if right.Height != frame.Height {
+		right = frame
+	}
+	switch g.mode {
+	case GLASSES_LEFT:
+		frame.copyFrom(left)
+	case GLASSES_RIGHT:
+		frame.copyFrom(right)
+	case GLASSES_ANAGLYPH:
+		// Red from the left eye, green and blue from the right one
+		for y := 0; y < frame.Height; y++ {
+			for x := 0; x < DISPLAY_WIDTH; x++ {
+				frame.Pixels[y<<DISPLAY_WIDTH_LOG2+x] = left.Color(x, y)&0x03 | right.Color(x, y)&0x3c
+			}
+			frame.Border[y] = left.BorderColor(y+frame.BorderTop())&0x03 | right.BorderColor(y+frame.BorderTop())&0x3c
+			frame.Palette[y] = identityPalette
+		}
+	case GLASSES_SIDE_BY_SIDE:
+		for y := 0; y < frame.Height; y++ {
+			for x := 0; x < DISPLAY_WIDTH/2; x++ {
+				frame.Pixels[y<<DISPLAY_WIDTH_LOG2+x] = left.Color(x*2, y)
+				frame.Pixels[y<<DISPLAY_WIDTH_LOG2+DISPLAY_WIDTH/2+x] = right.Color(x*2, y)
+			}
+			frame.Border[y] = left.BorderColor(y + frame.BorderTop())
+			frame.Palette[y] = identityPalette
+		}
+	}
+}
+
+// copyFrom copies the image of another frame.
+func (data *DisplayData) copyFrom(other *DisplayData) {
+	if data != other {
+		data.Pixels, data.Palette, data.Border = other.Pixels, other.Palette, other.Border
+	}
+}
@@ -0,0 +1,85 @@
+package sms
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+)
+
+// smsPalette contains the 64 colors of the Master System, indexed
+// by their --bbggrr value.
+var smsPalette = make(color.Palette, 64)
+
+func init() {
+	for c := range smsPalette {
+		smsPalette[c] = imageColor(byte(c))
+	}
+}
+
+// imageColor converts a color in the --bbggrr format of CRAM.
+func imageColor(val byte) color.RGBA {
+	c := smsColor(val)
+	return color.RGBA{c.r, c.g, c.b, 0xff}
+}
+
+// imageSize returns the size of the images of the frame. If border is
+// true the image covers the whole screen, otherwise only the active
+// display.
+func (data *DisplayData) imageSize(border bool) (width, height int) {
+	if border {
+		return SCREEN_WIDTH, SCREEN_HEIGHT
+	}
+	return DISPLAY_WIDTH, data.Height
+}
+
+// colorAt returns the color of the pixel at (x, y) of the image of
+// the frame.
+func (data *DisplayData) colorAt(x, y int, border bool) byte {
+	if !border {
+		return data.Color(x, y)
+	}
+	line := y - data.BorderTop()
+	if line >= 0 && line < data.Height && x >= BORDER_LEFT_RIGHT && x < BORDER_LEFT_RIGHT+DISPLAY_WIDTH {
+		return data.Color(x-BORDER_LEFT_RIGHT, line)
+	}
+	return data.BorderColor(y)
+}
+
+// Image converts the frame to an RGBA image.
+func (data *DisplayData) Image(border bool) *image.RGBA {
+	width, height := data.imageSize(border)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, imageColor(data.colorAt(x, y, border)))
+		}
+	}
+	return img
+}
+
+// Paletted converts the frame to an image whose palette is made of
+// the 64 colors of the Master System.
+func (data *DisplayData) Paletted(border bool) *image.Paletted {
+	width, height := data.imageSize(border)
+	img := image.NewPaletted(image.Rect(0, 0, width, height), smsPalette)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Pix[y*img.Stride+x] = data.colorAt(x, y, border)
+		}
+	}
+	return img
+}
+
+// WritePNG saves the frame as a PNG file.
+func (data *DisplayData) WritePNG(filename string, border bool) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, data.Image(border)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
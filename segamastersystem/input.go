@@ -1,28 +1,31 @@
 package sms
 
 import (
-	"github.com/scottferg/Go-SDL/sdl"
 	"github.com/remogatto/application"
+	"github.com/scottferg/Go-SDL/sdl"
+	"time"
 )
 
-var keyMap = map[string]int{
-	"up":    1, // Arrow keys
-	"down":  2,
-	"left":  4,
-	"right": 8,
-	"z":     16, // Z and X for fire
-	"x":     32,
-	"r":     1 << 12, // R for reset button
-}
-
 type inputLoop struct {
 	sms              *SMS
+	keyMap           map[string]int
+	hotkeyMap        map[string]string
+	gamepads         *gamepads
+	display          *sdlLoop
+	mouseButtons     int
+	mouseDevices     int // Uses of the mouse by the controllers
+	rescan           *time.Ticker
 	pause, terminate chan int
 }
 
-func NewInputLoop(sms *SMS) *inputLoop {
+func NewInputLoop(sms *SMS, config *Config, display *sdlLoop) *inputLoop {
 	return &inputLoop{
 		sms:       sms,
+		display:   display,
+		keyMap:    config.keyMap(),
+		hotkeyMap: config.hotkeyMap(),
+		gamepads:  newGamepads(sms, config.gamepadMap()),
+		rescan:    time.NewTicker(GAMEPAD_RESCAN_INTERVAL),
 		pause:     make(chan int),
 		terminate: make(chan int),
 	}
@@ -37,14 +40,28 @@ func (l *inputLoop) Terminate() chan int {
 }
 
 func (l *inputLoop) Run() {
+	// Ask once for the controllers plugged in, rather than sending
+	// every mouse event to the command loop
+	devices := make(chan int)
+	select {
+	case l.sms.Command <- CmdMouseDevices{devices}:
+		l.mouseDevices = <-devices
+	case <-l.terminate:
+		l.terminate <- 0
+		return
+	}
 	for {
 		select {
 		case <-l.pause:
 			l.pause <- 0
 
 		case <-l.terminate:
+			l.rescan.Stop()
 			l.terminate <- 0
 
+		case <-l.rescan.C:
+			l.gamepads.rescan()
+
 		case _event := <-sdl.Events:
 			switch e := _event.(type) {
 			case sdl.QuitEvent:
@@ -52,29 +69,111 @@ func (l *inputLoop) Run() {
 			case sdl.KeyboardEvent:
 				keyName := sdl.GetKeyName(sdl.Key(e.Keysym.Sym))
 				application.Debugf("%d: %s\n", e.Keysym.Sym, keyName)
+				if value, ok := l.keyMap[keyName]; ok {
+					if e.Type == sdl.KEYDOWN {
+						l.sms.Command <- CmdJoypadEvent{value, JOYPAD_DOWN}
+					} else if e.Type == sdl.KEYUP {
+						l.sms.Command <- CmdJoypadEvent{value, JOYPAD_UP}
+					}
+				}
 				if e.Type == sdl.KEYDOWN {
-					l.sms.Command <- CmdJoypadEvent{keyMap[keyName], JOYPAD_DOWN}
+					l.hotkey(l.hotkeyMap[keyName])
 				} else if e.Type == sdl.KEYUP {
-					l.sms.Command <- CmdJoypadEvent{keyMap[keyName], JOYPAD_UP}
-				}
-				if e.Type == sdl.KEYDOWN && keyName == "p" {
-					paused := make(chan bool)
-					l.sms.Paused = !l.sms.Paused
-					l.sms.Command <- CmdPauseEmulation{paused}
-					<-paused
+					l.hotkeyUp(l.hotkeyMap[keyName])
 				}
-				if e.Type == sdl.KEYDOWN && keyName == "d" {
-					l.sms.Paused = true
-					paused := make(chan bool)
-					l.sms.Command <- CmdPauseEmulation{paused}
-					<-paused
-					l.sms.Command <- CmdShowCurrentInstruction{}
+			case sdl.JoyAxisEvent, sdl.JoyHatEvent, sdl.JoyButtonEvent:
+				l.gamepads.event(e)
+			case sdl.MouseMotionEvent:
+				l.aim(int(e.X), int(e.Y))
+				l.move(int(e.Xrel), int(e.Yrel))
+			case sdl.MouseButtonEvent:
+				button := 0
+				switch e.Button {
+				case sdl.BUTTON_LEFT:
+					button = MOUSE_LEFT
+				case sdl.BUTTON_RIGHT:
+					button = MOUSE_RIGHT
 				}
-				if e.Keysym.Sym == sdl.K_ESCAPE {
-					application.Exit()
+				if e.Type == sdl.MOUSEBUTTONDOWN {
+					l.mouseButtons |= button
+				} else {
+					l.mouseButtons &^= button
 				}
+				l.aim(int(e.X), int(e.Y))
+				l.move(0, 0)
 
 			}
 		}
 	}
 }
+
+// aim points the Light Phaser, if any, at the mouse position.
+func (l *inputLoop) aim(x, y int) {
+	if l.mouseDevices&MOUSE_AIM == 0 {
+		return
+	}
+	x, y = l.display.displayPoint(x, y)
+	l.sms.Command <- CmdLightPhaser{x, y, l.mouseButtons&MOUSE_LEFT != 0}
+}
+
+// move reports the motion of the mouse to the paddles and Sports
+// Pads, if any.
+func (l *inputLoop) move(dx, dy int) {
+	if l.mouseDevices&MOUSE_MOTION == 0 {
+		return
+	}
+	l.sms.Command <- CmdMouse{dx, dy, l.mouseButtons}
+}
+
+// hotkey performs an emulator action.
+func (l *inputLoop) hotkey(action string) {
+	switch action {
+	case HOTKEY_PAUSE:
+		paused := make(chan bool)
+		l.sms.Paused = !l.sms.Paused
+		l.sms.Command <- CmdPauseEmulation{paused}
+		<-paused
+	case HOTKEY_DEBUG:
+		l.sms.Paused = true
+		paused := make(chan bool)
+		l.sms.Command <- CmdPauseEmulation{paused}
+		<-paused
+		l.sms.Command <- CmdShowCurrentInstruction{}
+	case HOTKEY_FRAME_ADVANCE:
+		if l.sms.Paused {
+			l.sms.Command <- CmdFrameAdvance{}
+		}
+	case HOTKEY_VGM_LOOP:
+		l.sms.Command <- CmdVGMLoop{}
+	case HOTKEY_VGM:
+		l.sms.Command <- CmdVGMLog{}
+	case HOTKEY_RECORD:
+		l.sms.Command <- CmdRecord{}
+	case HOTKEY_SCREENSHOT:
+		l.sms.Command <- CmdScreenshot{}
+	case HOTKEY_QUIT:
+		application.Exit()
+	case HOTKEY_REWIND:
+		l.sms.Command <- CmdRewind{true}
+	case HOTKEY_FAST_FORWARD:
+		l.sms.Command <- CmdFastForward{true}
+	case HOTKEY_TURBO:
+		l.sms.Command <- CmdTurbo{}
+	case HOTKEY_SLOWER:
+		l.sms.Command <- CmdSpeed{0.5}
+	case HOTKEY_FASTER:
+		l.sms.Command <- CmdSpeed{2}
+	case HOTKEY_UNTHROTTLED:
+		l.sms.Command <- CmdUnthrottled{}
+	}
+}
+
+// hotkeyUp ends the actions which last while their key is held.
+func (l *inputLoop) hotkeyUp(action string) {
+	switch action {
+	case HOTKEY_REWIND:
+		l.sms.Command <- CmdRewind{false}
+	case HOTKEY_FAST_FORWARD:
+		l.sms.Command <- CmdFastForward{false}
+	}
+}
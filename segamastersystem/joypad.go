@@ -0,0 +1,71 @@
+package sms
+
+// Joypad bits as seen by the game. The low byte is read from port
+// 0xdc and the high byte from port 0xdd. A button is pressed when
+// its bit is cleared.
+const (
+	JOYPAD1_UP = 1 << iota
+	JOYPAD1_DOWN
+	JOYPAD1_LEFT
+	JOYPAD1_RIGHT
+	JOYPAD1_FIRE1
+	JOYPAD1_FIRE2
+	JOYPAD2_UP
+	JOYPAD2_DOWN
+	JOYPAD2_LEFT
+	JOYPAD2_RIGHT
+	JOYPAD2_FIRE1
+	JOYPAD2_FIRE2
+	RESET_BUTTON
+)
+
+// Buttons of a joypad, independently of the player it belongs to.
+const (
+	BUTTON_UP = 1 << iota
+	BUTTON_DOWN
+	BUTTON_LEFT
+	BUTTON_RIGHT
+	BUTTON_FIRE1
+	BUTTON_FIRE2
+)
+
+// buttonNames maps button names, as used in the configuration, to
+// player-independent buttons.
+var buttonNames = map[string]int{
+	"up":    BUTTON_UP,
+	"down":  BUTTON_DOWN,
+	"left":  BUTTON_LEFT,
+	"right": BUTTON_RIGHT,
+	"fire1": BUTTON_FIRE1,
+	"fire2": BUTTON_FIRE2,
+}
+
+// JoypadValue returns the joypad bits of the buttons of the given
+// player, which is either 1 or 2.
+func JoypadValue(player, buttons int) int {
+	return buttons << uint(6*(player-1))
+}
+
+// PlayerJoypad presses or releases the buttons of the joypad of the
+// given player.
+func (sms *SMS) PlayerJoypad(player, buttons int, event byte) {
+	sms.Joypad(JoypadValue(player, buttons), event)
+}
+
+// JoypadButtons maps button names, as used in input scripts, to
+// joypad bits.
+var JoypadButtons = map[string]int{
+	"up":       JOYPAD1_UP,
+	"down":     JOYPAD1_DOWN,
+	"left":     JOYPAD1_LEFT,
+	"right":    JOYPAD1_RIGHT,
+	"fire1":    JOYPAD1_FIRE1,
+	"fire2":    JOYPAD1_FIRE2,
+	"p2-up":    JOYPAD2_UP,
+	"p2-down":  JOYPAD2_DOWN,
+	"p2-left":  JOYPAD2_LEFT,
+	"p2-right": JOYPAD2_RIGHT,
+	"p2-fire1": JOYPAD2_FIRE1,
+	"p2-fire2": JOYPAD2_FIRE2,
+	"reset":    RESET_BUTTON,
+}
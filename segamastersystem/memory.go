@@ -15,6 +15,9 @@ type Memory struct {
 	maskedPage1       byte
 	maskedPage2       byte
 	ramSelectRegister byte
+	glasses           byte // Last value written to the 3-D glasses
+	glassesUsed       bool
+	debugger          *Debugger // Checks the watchpoints
 	cpu               *z80.Z80
 }
 
@@ -95,14 +98,37 @@ func (memory *Memory) WriteByteInternal(address uint16, b byte) {
 	if address < 0xc000 {
 		return // Ignore ROM writes
 	}
+	if address >= 0xfff8 {
+		// 3-D glasses shutters, also mirrored in RAM
+		memory.glasses = b
+		memory.glassesUsed = true
+	}
 	memory.ram[address&0x1fff] = b
 }
 
+// eye returns the eye of the 3-D glasses whose shutter is open.
+func (memory *Memory) eye() int {
+	if !memory.glassesUsed {
+		return EYE_BOTH
+	}
+	if (memory.glasses & 1) != 0 {
+		return EYE_RIGHT
+	}
+	return EYE_LEFT
+}
+
 func (memory *Memory) ReadByte(address uint16) byte {
-	return memory.ReadByteInternal(address)
+	b := memory.ReadByteInternal(address)
+	if memory.debugger != nil {
+		memory.watch(address, b, false)
+	}
+	return b
 }
 
 func (memory *Memory) WriteByte(address uint16, b byte) {
+	if memory.debugger != nil {
+		memory.watch(address, b, true)
+	}
 	memory.WriteByteInternal(address, b)
 }
 
@@ -0,0 +1,273 @@
+package sms
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/remogatto/application"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MOVIE_HEADER        = "sms-movie 1"
+	MOVIE_HASH_INTERVAL = 50 // Frames between two recorded hashes
+)
+
+// Movie is a recording of the joypad events of a run from power on,
+// along with the hashes of some of its frames to check that the
+// playback stays in sync. Only the joypads are recorded.
+type Movie struct {
+	ROM         string // SHA-1 of the ROM
+	SpriteLimit bool
+	Frames      int
+	Events      []InputEvent
+	Hashes      map[int]string
+}
+
+// movieState tracks the movie being recorded or played.
+type movieState struct {
+	movie    *Movie
+	filename string // Where the movie is written, empty when playing
+	next     int    // Next event to play
+}
+
+// ReadMovie parses a movie file, made of the header followed by lines
+// of the form
+//
+//	rom <sha1>
+//	start power-on
+//	spritelimit on|off
+//	frames <number of frames>
+//	<frame> joypad <value> down|up
+//	<frame> hash <sha1>
+//
+// where value holds the JOYPAD1_*, JOYPAD2_* and RESET_BUTTON bits.
+func ReadMovie(r io.Reader) (*Movie, error) {
+	movie := &Movie{SpriteLimit: true, Hashes: make(map[int]string)}
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || scanner.Text() != MOVIE_HEADER {
+		return nil, fmt.Errorf("not a movie file")
+	}
+	for lineNum := 2; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var err error
+		switch {
+		case len(fields) == 2 && fields[0] == "rom":
+			movie.ROM = fields[1]
+		case len(fields) == 2 && fields[0] == "start":
+			if fields[1] != "power-on" {
+				err = fmt.Errorf("unsupported starting state %q", fields[1])
+			}
+		case len(fields) == 2 && fields[0] == "spritelimit":
+			movie.SpriteLimit = fields[1] != "off"
+		case len(fields) == 2 && fields[0] == "frames":
+			movie.Frames, err = strconv.Atoi(fields[1])
+		case len(fields) == 4 && fields[1] == "joypad":
+			err = movie.parseEvent(fields)
+		case len(fields) == 3 && fields[1] == "hash":
+			var frame int
+			if frame, err = strconv.Atoi(fields[0]); err == nil {
+				movie.Hashes[frame] = fields[2]
+			}
+		default:
+			err = fmt.Errorf("unexpected %q", scanner.Text())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(movie.Events, func(i, j int) bool {
+		return movie.Events[i].Frame < movie.Events[j].Frame
+	})
+	return movie, nil
+}
+
+// LoadMovie reads the movie file at path.
+func LoadMovie(path string) (*Movie, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	movie, err := ReadMovie(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return movie, nil
+}
+
+func (movie *Movie) parseEvent(fields []string) error {
+	frame, err := strconv.Atoi(fields[0])
+	if err != nil || frame < 1 {
+		return fmt.Errorf("invalid frame %q", fields[0])
+	}
+	value, err := strconv.ParseInt(fields[2], 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid joypad value %q", fields[2])
+	}
+	var event byte
+	switch fields[3] {
+	case "down":
+		event = JOYPAD_DOWN
+	case "up":
+		event = JOYPAD_UP
+	default:
+		return fmt.Errorf("expected down or up, got %q", fields[3])
+	}
+	movie.Events = append(movie.Events, InputEvent{frame, int(value), event})
+	return nil
+}
+
+// Write writes the movie in the format read by ReadMovie.
+func (movie *Movie) Write(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	spriteLimit := "on"
+	if !movie.SpriteLimit {
+		spriteLimit = "off"
+	}
+	fmt.Fprintf(b, "%s\nrom %s\nstart power-on\nspritelimit %s\nframes %d\n", MOVIE_HEADER, movie.ROM, spriteLimit, movie.Frames)
+	events := movie.Events
+	for frame := 1; frame <= movie.Frames; frame++ {
+		for ; len(events) > 0 && events[0].Frame <= frame; events = events[1:] {
+			event := "down"
+			if events[0].Event == JOYPAD_UP {
+				event = "up"
+			}
+			fmt.Fprintf(b, "%d joypad %#04x %s\n", events[0].Frame, events[0].Value, event)
+		}
+		if hash, ok := movie.Hashes[frame]; ok {
+			fmt.Fprintf(b, "%d hash %s\n", frame, hash)
+		}
+	}
+	return b.Flush()
+}
+
+// RecordMovie starts recording a movie into filename. Movies start
+// at power on, so no frame must have been rendered yet.
+func (sms *SMS) RecordMovie(filename string) error {
+	if sms.movie != nil {
+		return fmt.Errorf("a movie is already being recorded or played")
+	}
+	if sms.frame != 0 {
+		return fmt.Errorf("movies can only be recorded from power on")
+	}
+	for i, controller := range sms.controllers {
+		if _, ok := controller.(*joypad); !ok {
+			return fmt.Errorf("movies can't record the device on controller port %d", i+1)
+		}
+	}
+	sms.movie = &movieState{
+		movie: &Movie{
+			ROM:         sms.romHash,
+			SpriteLimit: sms.vdp.spriteLimit,
+			Hashes:      make(map[int]string),
+		},
+		filename: filename,
+	}
+	return nil
+}
+
+// PlayMovie starts playing a movie back. While it plays, the joypad
+// events not coming from the movie are ignored.
+func (sms *SMS) PlayMovie(movie *Movie) error {
+	if sms.movie != nil {
+		return fmt.Errorf("a movie is already being recorded or played")
+	}
+	if sms.frame != 0 {
+		return fmt.Errorf("movies can only be played from power on")
+	}
+	if movie.ROM != sms.romHash {
+		return fmt.Errorf("the movie was recorded with another ROM")
+	}
+	sms.SetSpriteLimit(movie.SpriteLimit)
+	sms.movie, sms.movieErr = &movieState{movie: movie}, nil
+	return nil
+}
+
+// StopMovie stops the movie being recorded, writing it, or played.
+func (sms *SMS) StopMovie() error {
+	if sms.movie == nil {
+		return fmt.Errorf("no movie is being recorded or played")
+	}
+	state := sms.movie
+	sms.movie = nil
+	if state.filename == "" {
+		return nil
+	}
+	state.movie.Frames = sms.frame
+	f, err := os.Create(state.filename)
+	if err != nil {
+		return err
+	}
+	if err := state.movie.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// MovieRecording returns true if a movie is being recorded.
+func (sms *SMS) MovieRecording() bool {
+	return sms.movie != nil && sms.movie.filename != ""
+}
+
+// MoviePlaying returns true if a movie is being played.
+func (sms *SMS) MoviePlaying() bool {
+	return sms.movie != nil && sms.movie.filename == ""
+}
+
+// MovieError returns the first loss of sync of the last movie
+// played, if any.
+func (sms *SMS) MovieError() error {
+	return sms.movieErr
+}
+
+// movieEvent records a joypad event, reporting whether it has to be
+// ignored because a movie is playing.
+func (sms *SMS) movieEvent(value int, event byte) bool {
+	if sms.MoviePlaying() {
+		return false
+	}
+	if sms.MovieRecording() {
+		movie := sms.movie.movie
+		movie.Events = append(movie.Events, InputEvent{sms.frame + 1, value, event})
+	}
+	return true
+}
+
+// playMovie sends the events due before rendering the next frame.
+func (sms *SMS) playMovie() {
+	state := sms.movie
+	for ; state.next < len(state.movie.Events) && state.movie.Events[state.next].Frame <= sms.frame+1; state.next++ {
+		event := state.movie.Events[state.next]
+		sms.joypad(event.Value, event.Event)
+	}
+}
+
+// checkMovie records or checks the hash of the frame just rendered.
+func (sms *SMS) checkMovie(frame *DisplayData) {
+	state := sms.movie
+	if state.filename != "" {
+		if sms.frame%MOVIE_HASH_INTERVAL == 0 {
+			state.movie.Hashes[sms.frame] = frame.Hash()
+		}
+		return
+	}
+	if hash, ok := state.movie.Hashes[sms.frame]; ok && sms.movieErr == nil && hash != frame.Hash() {
+		sms.movieErr = fmt.Errorf("movie out of sync at frame %d", sms.frame)
+		application.Logf("%s", sms.movieErr)
+	}
+	if sms.frame >= state.movie.Frames {
+		application.Logf("%s", "Movie finished")
+		sms.movie = nil
+	}
+}
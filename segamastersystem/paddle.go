@@ -0,0 +1,114 @@
+package sms
+
+// paddle is the Paddle Control. Its position is read a nibble at a
+// time, TR telling which one: the paddle flips it by itself at each
+// read, unless TH is set as an output to select the nibble, as done
+// by games on export consoles.
+type paddle struct {
+	position byte
+	button   bool
+	high     bool
+	thOutput bool
+}
+
+func (p *paddle) Read(strobe bool) byte {
+	if strobe && !p.thOutput {
+		p.high = !p.high
+	}
+	lines := byte(0x70)
+	if p.button {
+		lines &^= 0x10
+	}
+	if p.high {
+		lines &^= 0x20
+		return lines | p.position>>4
+	}
+	return lines | p.position&0x0f
+}
+
+func (p *paddle) Write(output PortOutput) {
+	p.thOutput = output.TH
+	if output.TH {
+		p.high = output.THLevel
+	}
+}
+
+func (p *paddle) Update() {}
+
+// mouse turns the paddle with the horizontal motion of the mouse.
+func (p *paddle) mouse(dx, dy, buttons int) {
+	position := int(p.position) + dx
+	if position < 0 {
+		position = 0
+	} else if position > 0xff {
+		position = 0xff
+	}
+	p.position = byte(position)
+	p.button = buttons&MOUSE_LEFT != 0
+}
+
+// sportsPad is the Sports Pad trackball. It reports its motion since
+// the previous read a nibble at a time: each change of TH, driven by
+// the console, selects the next one of X high, X low, Y high and Y
+// low.
+type sportsPad struct {
+	dx, dy  int  // Motion since the last latch
+	x, y    byte // Latched motion
+	step    int
+	th      bool
+	buttons int
+}
+
+func (s *sportsPad) Read(strobe bool) byte {
+	lines := byte(0x70)
+	if s.buttons&MOUSE_LEFT != 0 {
+		lines &^= 0x10
+	}
+	if s.buttons&MOUSE_RIGHT != 0 {
+		lines &^= 0x20
+	}
+	switch s.step {
+	case 1:
+		return lines | s.x>>4
+	case 2:
+		return lines | s.x&0x0f
+	case 3:
+		return lines | s.y>>4
+	}
+	return lines | s.y&0x0f
+}
+
+func (s *sportsPad) Write(output PortOutput) {
+	if !output.TH || output.THLevel == s.th {
+		return
+	}
+	s.th = output.THLevel
+	s.step = (s.step + 1) & 3
+	if s.step == 1 {
+		s.x, s.y = clampMotion(s.dx), clampMotion(s.dy)
+		s.dx, s.dy = 0, 0
+	}
+}
+
+// Update restarts the sequence of nibbles, which games read once per
+// frame.
+func (s *sportsPad) Update() {
+	s.step = 0
+}
+
+// mouse rolls the trackball with the motion of the mouse.
+func (s *sportsPad) mouse(dx, dy, buttons int) {
+	s.dx += dx
+	s.dy += dy
+	s.buttons = buttons
+}
+
+// clampMotion returns the motion as a signed byte.
+func clampMotion(d int) byte {
+	if d < -128 {
+		d = -128
+	} else if d > 127 {
+		d = 127
+	}
+	return byte(int8(d))
+}
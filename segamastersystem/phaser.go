@@ -0,0 +1,70 @@
+package sms
+
+const (
+	// Distance in pixels from the cursor within which the phaser
+	// sees the light of the screen
+	PHASER_RADIUS = 4
+
+	// Minimum sum of the red, green and blue levels of a pixel seen
+	// by the phaser
+	PHASER_BRIGHTNESS = 6
+
+	// Value of the H counter when the beam is at the leftmost pixel
+	// of the display
+	PHASER_HCOUNTER_OFFSET = 0x10
+)
+
+// lightPhaser is the Light Phaser. The trigger reads as TL and the
+// light sensor pulls TH low, which latches the H counter.
+type lightPhaser struct {
+	x, y    int
+	trigger bool
+	lit     bool
+}
+
+// LightPhaser aims the Light Phaser at (x, y), in display coordinates,
+// and sets the state of its trigger. It has no effect if no phaser is
+// connected.
+func (sms *SMS) LightPhaser(x, y int, trigger bool) {
+	if phaser := sms.vdp.phaser; phaser != nil {
+		phaser.x, phaser.y, phaser.trigger = x, y, trigger
+	}
+}
+
+func (phaser *lightPhaser) Read(strobe bool) byte {
+	lines := byte(0x7f)
+	if phaser.trigger {
+		lines &^= 0x10
+	}
+	if phaser.lit {
+		lines &^= 0x40
+	}
+	return lines
+}
+
+func (phaser *lightPhaser) Write(output PortOutput) {}
+
+func (phaser *lightPhaser) Update() {}
+
+// scan is called at the end of each line, line being outside the
+// display during the blanking periods. The sensor sees the light when
+// a bright pixel near the cursor has just been drawn.
+func (phaser *lightPhaser) scan(vdp *vdp, line int) {
+	lit := false
+	if line >= 0 && line < vdp.height && line >= phaser.y-PHASER_RADIUS && line <= phaser.y+PHASER_RADIUS {
+		for x := phaser.x - PHASER_RADIUS; x <= phaser.x+PHASER_RADIUS && !lit; x++ {
+			if x >= 0 && x < DISPLAY_WIDTH {
+				lit = brightness(vdp.displayData.Color(x, line)) >= PHASER_BRIGHTNESS
+			}
+		}
+	}
+	if lit && !phaser.lit {
+		vdp.hCounter = byte(phaser.x>>1 + PHASER_HCOUNTER_OFFSET)
+	}
+	phaser.lit = lit
+}
+
+// brightness returns the sum of the levels of a --bbggrr color.
+func brightness(color byte) int {
+	return int(color&3 + (color>>2)&3 + (color>>4)&3)
+}
@@ -17,17 +17,23 @@ func (p *Ports) init(sms *SMS) {
 }
 
 func (p *Ports) ReadPort(address uint16) byte {
-	return p.ReadPortInternal(address, true)
+	b := p.ReadPortInternal(address, true)
+	if p.sms.debugger != nil {
+		p.watch(address, b, false)
+	}
+	return b
 }
 
 func (p *Ports) ReadPortInternal(address uint16, contend bool) byte {
 	switch byte(address) {
-	case 0x7e, 0x7f:
+	case 0x7e:
 		return byte(p.sms.vdp.getLine())
+	case 0x7f:
+		return p.sms.vdp.hCounter
 	case 0xdc, 0xc0:
-		return byte(p.sms.joystick)
+		return p.sms.readPortDC()
 	case 0xdd, 0xc1:
-		return byte(p.sms.joystick >> 8)
+		return p.sms.readPortDD()
 	case 0xbe:
 		return p.sms.vdp.readByte()
 	case 0xbd, 0xbf:
@@ -41,26 +47,28 @@ func (p *Ports) ReadPortInternal(address uint16, contend bool) byte {
 }
 
 func (p *Ports) WritePort(address uint16, b byte) {
+	if p.sms.debugger != nil {
+		p.watch(address, b, true)
+	}
 	p.WritePortInternal(address, b, true)
 }
 
 func (p *Ports) WritePortInternal(address uint16, b byte, contend bool) {
 	switch byte(address) {
 	case 0x3f:
-		// Nationalisation, pretend we're British.
-		natbit := ((b >> 5) & 1)
-		if (b & 1) == 0 {
-			natbit = 1
-		}
-		p.sms.joystick = (p.sms.joystick & ^(1 << 6)) | int(natbit<<6)
-		natbit = ((b >> 7) & 1)
-		if (b & 4) == 0 {
-			natbit = 1
+		p.sms.writeIOControl(b)
+		break
+	case 0x06:
+		// Game Gear stereo register
+		if p.sms.vgm != nil {
+			p.sms.vgm.stereoWrite(b, p.sms.Cycles())
 		}
-		p.sms.joystick = (p.sms.joystick & ^(1 << 7)) | int(natbit<<7)
 		break
 	case 0x7e, 0x7f:
 		//	soundChip.poke(val);
+		if p.sms.vgm != nil {
+			p.sms.vgm.psgWrite(b, p.sms.Cycles())
+		}
 		break
 	case 0xbd, 0xbf:
 		p.sms.vdp.writeAddr(uint16(b))
@@ -70,7 +78,19 @@ func (p *Ports) WritePortInternal(address uint16, b byte, contend bool) {
 		break
 	case 0xde, 0xdf:
 		break // Unknown use
-	case 0xf0, 0xf1, 0xf2:
+	case 0xf0:
+		// YM2413 register select
+		if p.sms.vgm != nil {
+			p.sms.vgm.ymAddressWrite(b)
+		}
+		break
+	case 0xf1:
+		// YM2413 register data
+		if p.sms.vgm != nil {
+			p.sms.vgm.ymDataWrite(b, p.sms.Cycles())
+		}
+		break
+	case 0xf2:
 		break // YM2413 sound support: TODO
 		// default:
 		// 	console.log('IO port ' + hexbyte(addr) + ' = ' + val);
@@ -0,0 +1,202 @@
+package sms
+
+import (
+	"bufio"
+	"compress/lzw"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Recorder writes the frames produced by the emulator to a video
+// file. All the frames of a video have the size of the first one,
+// frames of a different height are cropped or padded with black.
+type Recorder interface {
+	WriteFrame(data *DisplayData) error
+	Close() error
+}
+
+// NewRecorder creates a video file whose format depends on the
+// extension of filename: ".y4m" for a YUV4MPEG2 stream which can be
+// fed to ffmpeg, ".gif" for an animated GIF.
+func NewRecorder(filename string, border bool) (Recorder, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext != ".y4m" && ext != ".gif" {
+		return nil, fmt.Errorf("unknown video format %q", ext)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	if ext == ".y4m" {
+		return &y4mRecorder{file: file, w: bufio.NewWriter(file), border: border}, nil
+	}
+	return &gifRecorder{file: file, w: bufio.NewWriter(file), border: border}, nil
+}
+
+// fitPaletted returns img with the given size.
+func fitPaletted(img *image.Paletted, width, height int) *image.Paletted {
+	if img.Rect.Dx() == width && img.Rect.Dy() == height {
+		return img
+	}
+	fit := image.NewPaletted(image.Rect(0, 0, width, height), img.Palette)
+	for y := 0; y < height && y < img.Rect.Dy(); y++ {
+		copy(fit.Pix[y*fit.Stride:(y+1)*fit.Stride], img.Pix[y*img.Stride:(y+1)*img.Stride])
+	}
+	return fit
+}
+
+// yuvColors contains the BT.601 Y, U and V components of the 64
+// colors of the Master System.
+var yuvColors [64][3]byte
+
+func init() {
+	for c := range yuvColors {
+		color := smsColor(byte(c))
+		r, g, b := int(color.r), int(color.g), int(color.b)
+		yuvColors[c][0] = byte((66*r+129*g+25*b+128)>>8 + 16)
+		yuvColors[c][1] = byte((-38*r-74*g+112*b+128)>>8 + 128)
+		yuvColors[c][2] = byte((112*r-94*g-18*b+128)>>8 + 128)
+	}
+}
+
+// y4mRecorder writes a 50 fps YUV4MPEG2 stream with no chroma
+// subsampling.
+type y4mRecorder struct {
+	file          *os.File
+	w             *bufio.Writer
+	border        bool
+	width, height int
+	frame         []byte
+}
+
+func (r *y4mRecorder) WriteFrame(data *DisplayData) error {
+	img := data.Paletted(r.border)
+	if r.frame == nil {
+		r.width, r.height = img.Rect.Dx(), img.Rect.Dy()
+		r.frame = make([]byte, r.width*r.height*3)
+		if _, err := fmt.Fprintf(r.w, "YUV4MPEG2 W%d H%d F50:1 Ip A1:1 C444\n", r.width, r.height); err != nil {
+			return err
+		}
+	}
+	img = fitPaletted(img, r.width, r.height)
+	planeSize := r.width * r.height
+	for y := 0; y < r.height; y++ {
+		for x := 0; x < r.width; x++ {
+			yuv := &yuvColors[img.Pix[y*img.Stride+x]]
+			i := y*r.width + x
+			r.frame[i] = yuv[0]
+			r.frame[planeSize+i] = yuv[1]
+			r.frame[2*planeSize+i] = yuv[2]
+		}
+	}
+	if _, err := r.w.WriteString("FRAME\n"); err != nil {
+		return err
+	}
+	_, err := r.w.Write(r.frame)
+	return err
+}
+
+func (r *y4mRecorder) Close() error {
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// gifRecorder streams an animated GIF, playing at 50 fps and
+// looping forever. The 64 colors of the Master System make its
+// global color table, so that frames are written as they come.
+type gifRecorder struct {
+	file          *os.File
+	w             *bufio.Writer
+	border        bool
+	width, height int
+	frames        int
+}
+
+func (r *gifRecorder) WriteFrame(data *DisplayData) error {
+	img := data.Paletted(r.border)
+	if r.frames == 0 {
+		r.width, r.height = img.Rect.Dx(), img.Rect.Dy()
+		r.writeHeader()
+	}
+	img = fitPaletted(img, r.width, r.height)
+	r.frames++
+	// Graphic control extension with a delay of 2/100 s
+	r.w.Write([]byte{0x21, 0xf9, 0x04, 0x00, 2, 0, 0x00, 0x00})
+	// Image descriptor covering the whole screen, no local color table
+	r.w.Write([]byte{0x2c, 0, 0, 0, 0, byte(r.width), byte(r.width >> 8), byte(r.height), byte(r.height >> 8), 0x00})
+	r.w.WriteByte(6) // LZW minimum code size for 64 colors
+	blocks := &gifBlockWriter{w: r.w}
+	lzww := lzw.NewWriter(blocks, lzw.LSB, 6)
+	if _, err := lzww.Write(img.Pix); err != nil {
+		return err
+	}
+	if err := lzww.Close(); err != nil {
+		return err
+	}
+	blocks.flush()
+	return r.w.WriteByte(0x00) // Block terminator
+}
+
+func (r *gifRecorder) writeHeader() {
+	r.w.WriteString("GIF89a")
+	// Logical screen descriptor with a global color table of 64
+	// colors of 8 bits per primary
+	r.w.Write([]byte{byte(r.width), byte(r.width >> 8), byte(r.height), byte(r.height >> 8), 0xf5, 0x00, 0x00})
+	for _, c := range smsPalette {
+		red, green, blue, _ := c.RGBA()
+		r.w.Write([]byte{byte(red >> 8), byte(green >> 8), byte(blue >> 8)})
+	}
+	// Loop forever
+	r.w.Write([]byte{0x21, 0xff, 0x0b})
+	r.w.WriteString("NETSCAPE2.0")
+	r.w.Write([]byte{0x03, 0x01, 0x00, 0x00, 0x00})
+}
+
+func (r *gifRecorder) Close() error {
+	if r.frames == 0 {
+		r.file.Close()
+		return fmt.Errorf("no frames recorded")
+	}
+	r.w.WriteByte(0x3b) // Trailer
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// gifBlockWriter splits the image data of a GIF into sub-blocks of
+// up to 255 bytes.
+type gifBlockWriter struct {
+	w   *bufio.Writer
+	buf [255]byte
+	n   int
+}
+
+func (b *gifBlockWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		b.buf[b.n] = c
+		if b.n++; b.n == len(b.buf) {
+			if err := b.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (b *gifBlockWriter) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	b.w.WriteByte(byte(b.n))
+	_, err := b.w.Write(b.buf[:b.n])
+	b.n = 0
+	return err
+}
@@ -0,0 +1,174 @@
+package sms
+
+import (
+	"encoding/binary"
+	"github.com/remogatto/application"
+)
+
+const (
+	REWIND_INTERVAL    = 5        // Frames between two saved states
+	REWIND_BUFFER_SIZE = 16 << 20 // Bytes of deltas kept
+)
+
+// rewindBuffer keeps the last saved state in full and, for each
+// earlier state, its delta from the state saved after it. The oldest
+// deltas are dropped to keep the buffer within its size.
+//
+// The buffers are reused from one state to the next, so that saving
+// the states doesn't keep the garbage collector busy.
+type rewindBuffer struct {
+	snapshot snapshot
+	current  []byte
+	next     []byte   // Where the next state is saved
+	scratch  []byte   // Where the deltas are encoded
+	deltas   [][]byte // Oldest first
+	spare    [][]byte // Deltas dropped or applied, to be reused
+	saved    bool     // Whether current holds a state
+	size     int
+	maxSize  int
+	frames   int // Frames rendered since the current state
+}
+
+// EnableRewind starts saving the state of the machine every few
+// frames, using up to maxSize bytes, so that Rewind can go back in
+// time.
+func (sms *SMS) EnableRewind(maxSize int) {
+	sms.rewind = &rewindBuffer{
+		current: make([]byte, stateSize),
+		next:    make([]byte, stateSize),
+		maxSize: maxSize,
+	}
+}
+
+// Rewind goes back to the previous saved state and renders the frame
+// following it. It returns nil when there is no earlier state, or
+// when a movie is being recorded or played. The caller must Release
+// the frame.
+//
+// The VGM log and the debugger are suspended while the frame is
+// emulated, as it was logged and checked when first played.
+func (sms *SMS) Rewind() *DisplayData {
+	r := sms.rewind
+	if r == nil || !r.saved || sms.movie != nil {
+		return nil
+	}
+	// Go back to the current state first if the machine has moved
+	// on from it.
+	if r.frames == 0 && !r.pop() {
+		return nil
+	}
+	if err := sms.loadState(&r.snapshot, r.current); err != nil {
+		application.Logf("Can't rewind: %s", err)
+		return nil
+	}
+	r.frames = 0
+	vgm, debugger := sms.vgm, sms.debugger
+	sms.vgm, sms.debugger, sms.memory.debugger = nil, nil, nil
+	frame := sms.renderFrame()
+	sms.vgm, sms.debugger, sms.memory.debugger = vgm, debugger, debugger
+	return frame
+}
+
+// saveRewindState is called after each frame rendered while playing.
+func (sms *SMS) saveRewindState() {
+	r := sms.rewind
+	r.frames++
+	if r.frames >= REWIND_INTERVAL {
+		if err := sms.saveState(&r.snapshot, r.next); err != nil {
+			application.Logf("Rewind disabled: %s", err)
+			sms.rewind = nil
+			return
+		}
+		r.push()
+		r.frames = 0
+	}
+}
+
+// push turns the state saved into next into the current one.
+func (r *rewindBuffer) push() {
+	if r.saved {
+		r.scratch = encodeDelta(r.scratch[:0], r.current, r.next)
+		delta := r.newDelta(len(r.scratch))
+		copy(delta, r.scratch)
+		r.deltas = append(r.deltas, delta)
+		r.size += len(delta)
+	}
+	r.current, r.next = r.next, r.current
+	r.saved = true
+	for r.size > r.maxSize && len(r.deltas) > 0 {
+		r.size -= len(r.deltas[0])
+		r.spare = append(r.spare, r.deltas[0])
+		r.deltas[0] = nil
+		r.deltas = r.deltas[1:]
+	}
+}
+
+// newDelta returns a slice of n bytes, reusing the last spare one if
+// it is large enough and dropping it otherwise.
+func (r *rewindBuffer) newDelta(n int) []byte {
+	if last := len(r.spare) - 1; last >= 0 {
+		delta := r.spare[last]
+		r.spare[last] = nil
+		r.spare = r.spare[:last]
+		if cap(delta) >= n {
+			return delta[:n]
+		}
+	}
+	return make([]byte, n)
+}
+
+// pop turns the current state into the one saved before it.
+func (r *rewindBuffer) pop() bool {
+	if len(r.deltas) == 0 {
+		return false
+	}
+	delta := r.deltas[len(r.deltas)-1]
+	r.deltas = r.deltas[:len(r.deltas)-1]
+	r.size -= len(delta)
+	applyDelta(r.current, delta)
+	r.spare = append(r.spare, delta)
+	return true
+}
+
+// encodeDelta appends to delta the XOR of two states of the same
+// size, as pairs of a run of unchanged bytes and a run of changed
+// ones followed by the changed bytes XORed. Run lengths are uvarints.
+func encodeDelta(delta, a, b []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	for i := 0; i < len(a); {
+		same := 0
+		for i+same < len(a) && a[i+same] == b[i+same] {
+			same++
+		}
+		i += same
+		changed := 0
+		for i+changed < len(a) && a[i+changed] != b[i+changed] {
+			changed++
+		}
+		delta = append(delta, buf[:binary.PutUvarint(buf[:], uint64(same))]...)
+		delta = append(delta, buf[:binary.PutUvarint(buf[:], uint64(changed))]...)
+		for j := i; j < i+changed; j++ {
+			delta = append(delta, a[j]^b[j])
+		}
+		i += changed
+	}
+	return delta
+}
+
+// applyDelta XORs a state with a delta returned by encodeDelta, which
+// turns either state into the other one.
+func applyDelta(state, delta []byte) {
+	i := 0
+	for len(delta) > 0 {
+		same, n := binary.Uvarint(delta)
+		delta = delta[n:]
+		changed, n := binary.Uvarint(delta)
+		delta = delta[n:]
+		i += int(same)
+		for j := 0; j < int(changed); j++ {
+			state[i+j] ^= delta[j]
+		}
+		delta = delta[changed:]
+		i += int(changed)
+	}
+}
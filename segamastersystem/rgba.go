@@ -4,6 +4,16 @@ import (
 	"fmt"
 )
 
+// colorValues maps the 64 colors of the Master System to 32-bit
+// pixel values.
+var colorValues [64]uint32
+
+func init() {
+	for c := range colorValues {
+		colorValues[c] = smsColor(byte(c)).value32()
+	}
+}
+
 type rgba struct {
 	r, g, b, a byte
 }
@@ -15,3 +25,17 @@ func (color rgba) value32() uint32 {
 func (color rgba) String() string {
 	return fmt.Sprintf("R: %d G: %d B: %d A: %d", color.r, color.g, color.b, color.a)
 }
+
+// smsColor converts a color in the --bbggrr format of CRAM.
+func smsColor(val byte) rgba {
+	r := val & 3
+	r |= r << 2
+	r |= r << 4
+	g := (val >> 2) & 3
+	g |= g << 2
+	g |= g << 4
+	b := (val >> 4) & 3
+	b |= b << 2
+	b |= b << 4
+	return rgba{r, g, b, 0}
+}
@@ -0,0 +1,81 @@
+package sms
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// InputEvent is a joypad event taking effect before the given frame
+// is rendered. Frames are numbered from 1.
+type InputEvent struct {
+	Frame int
+	Value int
+	Event byte
+}
+
+// InputScript feeds a scripted sequence of joypad events to the
+// emulator.
+type InputScript struct {
+	events []InputEvent
+	next   int
+}
+
+// ReadInputScript parses an input script. Empty lines and lines
+// starting with '#' are ignored, the others have the form
+//
+//	<frame> <button> down|up
+//
+// where button is one of the names in JoypadButtons.
+func ReadInputScript(r io.Reader) (*InputScript, error) {
+	script := &InputScript{}
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected <frame> <button> down|up", lineNum)
+		}
+		frame, err := strconv.Atoi(fields[0])
+		if err != nil || frame < 1 {
+			return nil, fmt.Errorf("line %d: invalid frame %q", lineNum, fields[0])
+		}
+		value, ok := JoypadButtons[fields[1]]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown button %q", lineNum, fields[1])
+		}
+		var event byte
+		switch fields[2] {
+		case "down":
+			event = JOYPAD_DOWN
+		case "up":
+			event = JOYPAD_UP
+		default:
+			return nil, fmt.Errorf("line %d: expected down or up, got %q", lineNum, fields[2])
+		}
+		script.events = append(script.events, InputEvent{frame, value, event})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(script.events, func(i, j int) bool {
+		return script.events[i].Frame < script.events[j].Frame
+	})
+	return script, nil
+}
+
+// Apply sends to the emulator the events due before rendering the
+// given frame.
+func (script *InputScript) Apply(sms *SMS, frame int) {
+	for script.next < len(script.events) && script.events[script.next].Frame <= frame {
+		event := script.events[script.next]
+		sms.Joypad(event.Value, event.Event)
+		script.next++
+	}
+}
@@ -1,9 +1,11 @@
 package sms
 
 import (
-	"github.com/scottferg/Go-SDL/sdl"
 	"github.com/remogatto/application"
+	"github.com/scottferg/Go-SDL/sdl"
 	"log"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -46,19 +48,18 @@ func newSDLSurface(w, h int) *sdlSurface {
 
 // Create an SDL surface suitable for an unscaled screen
 func newUnscaledSurface() *sdlSurface {
-	return newSDLSurface(DISPLAY_WIDTH, DISPLAY_HEIGHT)
+	return newSDLSurface(DISPLAY_WIDTH, DISPLAY_MAX_HEIGHT)
 }
 
 type sdlScreen interface {
-	renderDisplay(data *DisplayData, colorValues [32]uint32) *sdlSurface
+	renderDisplay(data *DisplayData) *sdlSurface
 	display() *sdlSurface
-	border() *sdlSurface
 	screen() *sdlSurface
-	displayRect() *sdl.Rect
+	displayRect(height int) *sdl.Rect
 }
 
 type sdlUnscaledScreen struct {
-	screenSurface, borderSurface, displaySurface *sdlSurface
+	screenSurface, displaySurface *sdlSurface
 }
 
 func newSDLUnscaledScreen() *sdlUnscaledScreen {
@@ -68,43 +69,31 @@ func newSDLUnscaledScreen() *sdlUnscaledScreen {
 		application.Exit()
 		return nil
 	}
-	borderSurface := &sdlSurface{sdl.CreateRGBSurface(sdl.SWSURFACE, SCREEN_WIDTH, SCREEN_HEIGHT, 32, 0, 0, 0, 0)}
-	if borderSurface.surface == nil {
-		log.Printf("%s", sdl.GetError())
-		application.Exit()
-		return nil
-	}
-	displaySurface := &sdlSurface{sdl.CreateRGBSurface(sdl.SWSURFACE, DISPLAY_WIDTH, DISPLAY_HEIGHT, 32, 0, 0, 0, 0)}
+	displaySurface := &sdlSurface{sdl.CreateRGBSurface(sdl.SWSURFACE, DISPLAY_WIDTH, DISPLAY_MAX_HEIGHT, 32, 0, 0, 0, 0)}
 	if displaySurface.surface == nil {
 		log.Printf("%s", sdl.GetError())
 		application.Exit()
 		return nil
 	}
-	return &sdlUnscaledScreen{screenSurface, borderSurface, displaySurface}
+	return &sdlUnscaledScreen{screenSurface, displaySurface}
 }
 
-func (screen *sdlUnscaledScreen) renderDisplay(data *DisplayData, paletteR, paletteG, paletteB []byte) *sdlSurface {
+func (screen *sdlUnscaledScreen) renderDisplay(data *DisplayData) *sdlSurface {
 	surface := screen.displaySurface
 	surface.surface.Lock()
-	for y := uint(0); y < DISPLAY_HEIGHT; y++ {
-		wy := y * DISPLAY_WIDTH
+	for y := uint(0); y < uint(data.Height); y++ {
 		for x := uint(0); x < DISPLAY_WIDTH; x++ {
 			addr := surface.addrXY(x, y)
-			index := data[wy+x]
-			color := rgba{paletteR[index], paletteG[index], paletteB[index], 0}
-			*(*uint32)(unsafe.Pointer(addr)) = color.value32()
+			*(*uint32)(unsafe.Pointer(addr)) = colorValues[data.Color(int(x), int(y))]
 		}
 	}
 	surface.surface.Unlock()
 	return surface
 }
 
-func (screen *sdlUnscaledScreen) displayRect() *sdl.Rect {
-	return &sdl.Rect{BORDER_LEFT_RIGHT, BORDER_TOP_BOTTOM, DISPLAY_WIDTH, DISPLAY_HEIGHT}
-}
-
-func (screen *sdlUnscaledScreen) border() *sdlSurface {
-	return screen.borderSurface
+func (screen *sdlUnscaledScreen) displayRect(height int) *sdl.Rect {
+	top := (SCREEN_HEIGHT - height) / 2
+	return &sdl.Rect{BORDER_LEFT_RIGHT, int16(top), DISPLAY_WIDTH, uint16(height)}
 }
 
 func (screen *sdlUnscaledScreen) screen() *sdlSurface {
@@ -116,71 +105,80 @@ func (screen *sdlUnscaledScreen) display() *sdlSurface {
 }
 
 type sdl2xScreen struct {
-	screenSurface, borderSurface, displaySurface *sdlSurface
+	screenSurface, displaySurface *sdlSurface
+	vsync                         bool
 }
 
 func NewSDL2xScreen(fullScreen bool) *sdl2xScreen {
+	return NewSDL2xScreenVSync(fullScreen, false)
+}
+
+// NewSDL2xScreenVSync creates a 2x screen which, if vsync is true, is
+// double buffered so that flipping it waits for the vertical retrace
+// of the host display. Many video drivers, in windowed mode at least,
+// can't do it: VSync then returns false.
+func NewSDL2xScreenVSync(fullScreen, vsync bool) *sdl2xScreen {
 	sdlMode := uint32(sdl.SWSURFACE)
 	if fullScreen {
 		application.Logf("%s", "Activate fullscreen mode")
 		sdlMode = sdl.FULLSCREEN
 		sdl.ShowCursor(sdl.DISABLE)
 	}
+	if vsync {
+		sdlMode |= sdl.HWSURFACE | sdl.DOUBLEBUF
+	}
 	screenSurface := &sdlSurface{sdl.SetVideoMode(SCREEN_WIDTH*2, SCREEN_HEIGHT*2, 32, sdlMode)}
 	if screenSurface.surface == nil {
 		log.Printf("%s", sdl.GetError())
 		application.Exit()
 		return nil
 	}
-	borderSurface := &sdlSurface{sdl.CreateRGBSurface(sdl.SWSURFACE, SCREEN_WIDTH*2, SCREEN_HEIGHT*2, 32, 0, 0, 0, 0)}
-	if borderSurface.surface == nil {
-		log.Printf("%s", sdl.GetError())
-		application.Exit()
-		return nil
+	if vsync && screenSurface.surface.Flags&(sdl.HWSURFACE|sdl.DOUBLEBUF) != sdl.HWSURFACE|sdl.DOUBLEBUF {
+		application.Logf("%s", "No double buffered hardware surface, vsync not available")
+		vsync = false
 	}
-	displaySurface := &sdlSurface{sdl.CreateRGBSurface(sdl.SWSURFACE, DISPLAY_WIDTH*2, DISPLAY_HEIGHT*2, 32, 0, 0, 0, 0)}
+	displaySurface := &sdlSurface{sdl.CreateRGBSurface(sdl.SWSURFACE, DISPLAY_WIDTH*2, DISPLAY_MAX_HEIGHT*2, 32, 0, 0, 0, 0)}
 	if displaySurface.surface == nil {
 		log.Printf("%s", sdl.GetError())
 		application.Exit()
 		return nil
 	}
-	return &sdl2xScreen{screenSurface, borderSurface, displaySurface}
+	return &sdl2xScreen{screenSurface, displaySurface, vsync}
 }
 
-func (screen *sdl2xScreen) renderDisplay(data *DisplayData, colorValues [32]uint32) *sdlSurface {
+func (screen *sdl2xScreen) renderDisplay(data *DisplayData) *sdlSurface {
 	surface := screen.displaySurface
 	bpp := surface.bpp()
 	pitch := surface.pitch()
 	pixels := uintptr(surface.surface.Pixels)
-	size := DISPLAY_SIZE
 	ptrBpp := uintptr(bpp)
 	ptrPitch := uintptr(pitch)
 	ptrBpp_ptrPitch := ptrBpp + ptrPitch
-	x, y := uint(0), uint(0)
 	surface.surface.Lock()
-	for c := 0; c < size; c++ {
+	for y := uint(0); y < uint(data.Height); y++ {
 		wy := y << DISPLAY_WIDTH_LOG2
 		scanlineLen := (y * pitch) << 1
-		x %= DISPLAY_WIDTH
-		offset := uintptr(scanlineLen + x<<1*bpp)
-		addr := uintptr(pixels + offset)
-		color := colorValues[data[wy+x]]
-		// Fill a 2x2 rectangle
-		*(*uint32)(unsafe.Pointer(addr)) = color
-		*(*uint32)(unsafe.Pointer(addr + ptrBpp)) = color
-		*(*uint32)(unsafe.Pointer(addr + ptrPitch)) = color
-		*(*uint32)(unsafe.Pointer(addr + ptrBpp_ptrPitch)) = color
-		x++
-		if x == DISPLAY_WIDTH {
-			y++
+		// Each line is converted with the palette it was rasterized with
+		palette := &data.Palette[y]
+		for x := uint(0); x < DISPLAY_WIDTH; x++ {
+			offset := uintptr(scanlineLen + x<<1*bpp)
+			addr := uintptr(pixels + offset)
+			color := colorValues[palette[data.Pixels[wy+x]]&0x3f]
+			// Fill a 2x2 rectangle
+			*(*uint32)(unsafe.Pointer(addr)) = color
+			*(*uint32)(unsafe.Pointer(addr + ptrBpp)) = color
+			*(*uint32)(unsafe.Pointer(addr + ptrPitch)) = color
+			*(*uint32)(unsafe.Pointer(addr + ptrBpp_ptrPitch)) = color
 		}
 	}
 	surface.surface.Unlock()
 	return surface
 }
 
-func (screen *sdl2xScreen) border() *sdlSurface {
-	return screen.borderSurface
+// VSync returns whether flipping the screen waits for the vertical
+// retrace, as far as SDL tells.
+func (screen *sdl2xScreen) VSync() bool {
+	return screen.vsync
 }
 
 func (screen *sdl2xScreen) screen() *sdlSurface {
@@ -191,28 +189,30 @@ func (screen *sdl2xScreen) display() *sdlSurface {
 	return screen.displaySurface
 }
 
-func (screen *sdl2xScreen) displayRect() *sdl.Rect {
-	return &sdl.Rect{BORDER_LEFT_RIGHT * 2, BORDER_TOP_BOTTOM * 2, DISPLAY_WIDTH * 2, DISPLAY_HEIGHT * 2}
+func (screen *sdl2xScreen) displayRect(height int) *sdl.Rect {
+	top := (SCREEN_HEIGHT - height) / 2
+	return &sdl.Rect{BORDER_LEFT_RIGHT * 2, int16(top * 2), DISPLAY_WIDTH * 2, uint16(height * 2)}
 }
 
 type sdlLoop struct {
-	displayData                  chan *DisplayData
-	paletteValue                 chan PaletteValue
-	updateBorder                 chan byte
-	pause, terminate             chan int
-	paletteR, paletteG, paletteB [32]byte
-	colorValues                  [32]uint32
-	screen                       sdlScreen
+	displayData      chan *DisplayData
+	pause, terminate chan int
+	screen           sdlScreen
+	height           int32 // Height of the last rendered frame
+	flips            chan time.Time
+	repeat           chan int
+	last             DisplayData // Copy of the last rendered frame, for Repeat
 }
 
 func NewSDLLoop(screen sdlScreen) *sdlLoop {
 	return &sdlLoop{
-		screen:       screen,
-		displayData:  make(chan *DisplayData),
-		paletteValue: make(chan PaletteValue),
-		updateBorder: make(chan byte),
-		pause:        make(chan int),
-		terminate:    make(chan int),
+		screen:      screen,
+		height:      DISPLAY_HEIGHT,
+		displayData: make(chan *DisplayData),
+		flips:       make(chan time.Time, 1),
+		repeat:      make(chan int, 1),
+		pause:       make(chan int),
+		terminate:   make(chan int),
 	}
 }
 
@@ -228,12 +228,18 @@ func (l *sdlLoop) Display() chan<- *DisplayData {
 	return l.displayData
 }
 
-func (l *sdlLoop) WritePalette() chan<- PaletteValue {
-	return l.paletteValue
+// Flips returns a channel receiving the time the screen was last
+// flipped, after each rendered frame. Flips not yet received are
+// dropped.
+func (l *sdlLoop) Flips() <-chan time.Time {
+	return l.flips
 }
 
-func (l *sdlLoop) UpdateBorder() chan<- byte {
-	return l.updateBorder
+// Repeat returns a channel which renders and flips the last frame
+// again, without waiting for a new one. Requests not yet served are
+// merged.
+func (l *sdlLoop) Repeat() chan<- int {
+	return l.repeat
 }
 
 func (l *sdlLoop) Run() {
@@ -247,43 +253,61 @@ func (l *sdlLoop) Run() {
 
 		case data := <-l.displayData:
 			l.Render(data)
+			l.last.copyFrom(data)
+			l.last.Height = data.Height
+			data.Release()
 
-		case value := <-l.paletteValue:
-			l.paletteR[value.index] = value.r
-			l.paletteG[value.index] = value.g
-			l.paletteB[value.index] = value.b
-			l.calcColor(value.index, value.r, value.g, value.b)
-		case value := <-l.updateBorder:
-			l.renderBorder(value)
+		case <-l.repeat:
+			if l.last.Height != 0 {
+				l.Render(&l.last)
+			}
 
 		}
 	}
 }
 
 func (l *sdlLoop) Render(data *DisplayData) {
-	displayRect := l.screen.displayRect()
+	atomic.StoreInt32(&l.height, int32(data.Height))
+	displayRect := l.screen.displayRect(data.Height)
+	l.renderBorder(data, displayRect)
 	// render surface
-	displaySurface := l.screen.renderDisplay(data, l.colorValues)
-	// copy display surface on border surface
-	l.screen.border().surface.Blit(&sdl.Rect{0, 0, 0, 0}, displaySurface.surface, nil)
+	displaySurface := l.screen.renderDisplay(data)
 	// flip surface
-	l.screen.screen().surface.Blit(&sdl.Rect{displayRect.X, displayRect.Y, 0, 0}, l.screen.border().surface, nil)
+	l.screen.screen().surface.Blit(&sdl.Rect{displayRect.X, displayRect.Y, 0, 0}, displaySurface.surface, &sdl.Rect{0, 0, displayRect.W, displayRect.H})
 	l.screen.screen().surface.Flip()
+	select {
+	case l.flips <- time.Now():
+	default:
+	}
 }
 
-func (l *sdlLoop) renderBorder(index byte) {
-	color := rgba{l.paletteR[index], l.paletteG[index], l.paletteB[index], 0}.value32()
-	display := l.screen.display()
-	border := l.screen.border()
-	border.surface.FillRect(nil, color)
-	displayRect := l.screen.displayRect()
-	// copy display surface on border surface
-	l.screen.screen().surface.Blit(nil, l.screen.border().surface, nil)
-	// flip surface
-	l.screen.screen().surface.Blit(&sdl.Rect{displayRect.X, displayRect.Y, 0, 0}, display.surface, nil)
-	l.screen.screen().surface.Flip()
+// renderBorder fills the screen with the border color of each line,
+// merging consecutive rows of the same color into a single fill.
+func (l *sdlLoop) renderBorder(data *DisplayData, displayRect *sdl.Rect) {
+	screen := l.screen.screen()
+	scale := int(displayRect.W) / DISPLAY_WIDTH
+	start, color := 0, data.BorderColor(0)
+	for y := 1; y <= SCREEN_HEIGHT; y++ {
+		if y < SCREEN_HEIGHT && data.BorderColor(y) == color {
+			continue
+		}
+		rect := &sdl.Rect{0, int16(start * scale), uint16(screen.width()), uint16((y - start) * scale)}
+		screen.surface.FillRect(rect, colorValues[color])
+		if y < SCREEN_HEIGHT {
+			start, color = y, data.BorderColor(y)
+		}
+	}
 }
 
-func (l *sdlLoop) calcColor(index, r, g, b byte) {
-	l.colorValues[index] = (uint32(r) << 16) | (uint32(g) << 8) | uint32(b)
+// displayPoint converts a point of the screen into display
+// coordinates, according to the height of the last rendered frame.
+// Points left of or above the display are mapped to (-1, -1).
+func (l *sdlLoop) displayPoint(x, y int) (int, int) {
+	rect := l.screen.displayRect(int(atomic.LoadInt32(&l.height)))
+	scale := int(rect.W) / DISPLAY_WIDTH
+	x, y = x-int(rect.X), y-int(rect.Y)
+	if x < 0 || y < 0 {
+		return -1, -1
+	}
+	return x / scale, y / scale
 }
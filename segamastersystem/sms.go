@@ -1,6 +1,8 @@
 package sms
 
 import (
+	"crypto/sha1"
+	"fmt"
 	"github.com/remogatto/application"
 	"github.com/remogatto/z80"
 )
@@ -32,32 +34,119 @@ type CmdPauseEmulation struct {
 
 type CmdShowCurrentInstruction struct{}
 
+// CmdScreenshot saves the last rendered frame as a PNG file. If
+// Filename is empty a name based on the current time is used.
+type CmdScreenshot struct {
+	Filename string
+}
+
+// CmdRecord starts recording a video into Filename, or stops the
+// recording in progress. If Filename is empty an animated GIF named
+// after the current time is recorded.
+type CmdRecord struct {
+	Filename string
+}
+
+// CmdVGMLog starts logging the sound chip writes into a VGM file, or
+// stops the logging in progress. If Filename is empty a name based
+// on the current time is used.
+type CmdVGMLog struct {
+	Filename string
+}
+
+// CmdVGMLoop marks the loop point of the VGM file being logged.
+type CmdVGMLoop struct{}
+
+// CmdRewind starts or stops rewinding the emulation.
+type CmdRewind struct {
+	Rewinding bool
+}
+
+// CmdRewindFrame goes back to the previous rewind point and shows the
+// frame following it.
+type CmdRewindFrame struct{}
+
+// CmdFrameAdvance renders a single frame while the emulation is
+// paused.
+type CmdFrameAdvance struct{}
+
+// CmdFastForward starts or stops fast-forwarding.
+type CmdFastForward struct {
+	On bool
+}
+
+// CmdTurbo toggles fast-forwarding.
+type CmdTurbo struct{}
+
+// CmdSpeed multiplies the speed of the emulation by Factor.
+type CmdSpeed struct {
+	Factor float64
+}
+
+// CmdUnthrottled toggles running the emulation as fast as possible.
+type CmdUnthrottled struct{}
+
+// CmdLightPhaser aims the Light Phaser at (X, Y), in display
+// coordinates, and presses or releases its trigger.
+type CmdLightPhaser struct {
+	X, Y    int
+	Trigger bool
+}
+
+// CmdMouse reports the relative motion of the mouse and the buttons
+// held to the paddles and Sports Pads.
+type CmdMouse struct {
+	DX, DY  int
+	Buttons int
+}
+
+// CmdMouseDevices replies on Devices with the MOUSE_AIM and
+// MOUSE_MOTION flags of the controllers plugged in.
+type CmdMouseDevices struct {
+	Devices chan int
+}
+
 type SMS struct {
-	cpu      *z80.Z80
-	memory   *Memory
-	vdp      *vdp
-	ports    *Ports
-	joystick int
-	Paused   bool
-	Command  chan interface{}
+	cpu         *z80.Z80
+	memory      *Memory
+	vdp         *vdp
+	ports       *Ports
+	controllers [2]ControllerPort
+	ioControl   byte // Last value written to port 0x3f
+	reset       bool // Reset button held
+	frames      *FramePool
+	cycles      uint64 // Emulated cycles at the start of the current line
+	romName     string
+	romHash     string // SHA-1 of the ROM
+	frame       int    // Frames rendered since power on
+	movie       *movieState
+	movieErr    error
+	rewind      *rewindBuffer
+	vgm         *VGMLogger
+	debugger    *Debugger
+	Paused      bool
+	Command     chan interface{}
 }
 
-func NewSMS(displayLoop DisplayLoop) *SMS {
+func NewSMS() *SMS {
 	memory := NewMemory()
-	vdp := newVDP(displayLoop)
+	vdp := newVDP()
 	ports := NewPorts()
 	cpu := z80.NewZ80(memory, ports)
 
 	sms := &SMS{
-		cpu:      cpu,
-		memory:   memory,
-		ports:    ports,
-		vdp:      vdp,
-		joystick: 0xffff,
-		Command:  make(chan interface{}),
+		cpu:       cpu,
+		memory:    memory,
+		ports:     ports,
+		vdp:       vdp,
+		frames:    NewFramePool(FRAME_POOL_SIZE),
+		ioControl: 0xff,
+		Command:   make(chan interface{}),
 	}
 	sms.memory.init(cpu)
 	sms.ports.init(sms)
+	sms.Plug(1, &joypad{})
+	sms.Plug(2, &joypad{})
 	return sms
 }
 
@@ -67,6 +156,8 @@ func (sms *SMS) LoadROM(fileName string) {
 	if err != nil {
 		panic(err)
 	}
+	sms.romName = fileName
+	sms.romHash = fmt.Sprintf("%x", sha1.Sum(data))
 	size := len(data)
 	// Calculate number of pages from file size and create array appropriately
 	numROMBanks := size / PAGE_SIZE
@@ -91,24 +182,70 @@ func (sms *SMS) LoadROM(fileName string) {
 	copy(sms.memory.romBank0, sms.memory.romBanks[sms.memory.maskedPage0][:])
 }
 
+// RenderFrame emulates the machine until the VDP has completed a
+// frame. The status register is left untouched so that games can
+// read the VBlank, sprite overflow and collision flags.
+//
+// The returned frame is owned by the caller, which must Release it
+// once done with it. RenderFrame blocks while all the frames of the
+// pool are in use.
 func (sms *SMS) RenderFrame() *DisplayData {
-	sms.vdp.status = 0
-	for (sms.vdp.status & 2) == 0 {
-		sms.cpu.Tstates = (sms.cpu.Tstates % TStatesPerFrame)
+	if sms.MoviePlaying() {
+		sms.playMovie()
+	}
+	frame := sms.renderFrame()
+	sms.frame++
+	if sms.movie != nil {
+		sms.checkMovie(frame)
+	}
+	if sms.rewind != nil {
+		sms.saveRewindState()
+	}
+	return frame
+}
+
+func (sms *SMS) renderFrame() *DisplayData {
+	sms.vdp.displayData = sms.frames.Get()
+	for {
 		sms.cpu.EventNextEvent = TStatesPerFrame
 		sms.doOpcodes()
-		sms.vdp.status = sms.vdp.hblank()
-		if sms.vdp.status != 0 {
+		// Carry the overshoot into the next line, keeping Cycles
+		// right during the interrupt and between frames.
+		sms.cpu.Tstates -= TStatesPerFrame
+		sms.cycles += TStatesPerFrame
+		if sms.vdp.hblank() != 0 {
 			sms.cpu.Interrupt()
 		}
+		if sms.vdp.currentLine == 0 {
+			break
+		}
 	}
-	return &sms.vdp.displayData
+	sms.updateControllers()
+	frame := sms.vdp.displayData
+	frame.Eye = sms.memory.eye()
+	sms.vdp.displayData = nil
+	return frame
+}
+
+// Cycles returns the number of cycles emulated since power on.
+func (sms *SMS) Cycles() uint64 {
+	return sms.cycles + uint64(sms.cpu.Tstates)
+}
+
+// SetSpriteLimit enables or disables the limit of 8 sprites per
+// line. Disabling it reduces flicker in games that multiplex
+// sprites, although the overflow flag is still reported.
+func (sms *SMS) SetSpriteLimit(enabled bool) {
+	sms.vdp.spriteLimit = enabled
 }
 
 func (sms *SMS) doOpcodes() {
 	// Main instruction emulation loop
 	{
 		for (sms.cpu.Tstates < sms.cpu.EventNextEvent) && !sms.cpu.Halted {
+			if sms.debugger != nil {
+				sms.debugger.instruction(sms)
+			}
 			sms.memory.ContendRead(sms.cpu.PC(), 4)
 			opcode := sms.memory.ReadByteInternal(sms.cpu.PC())
 			sms.cpu.R = (sms.cpu.R + 1) & 0x7f
@@ -125,17 +262,3 @@ func (sms *SMS) doOpcodes() {
 		}
 	}
 }
-
-func (sms *SMS) Joypad(value int, event byte) {
-	switch event {
-	case JOYPAD_DOWN:
-		sms.joystick &= ^value
-		break
-	case JOYPAD_UP:
-		sms.joystick |= value
-		break
-	default:
-		application.Logf("%s", "Unknown joypad event")
-		break
-	}
-}
@@ -0,0 +1,122 @@
+package sms
+
+import (
+	"encoding/binary"
+)
+
+// snapshot is the state of the machine between two frames. The input
+// devices are not part of it, nor are the cycles emulated since power
+// on, which keep counting through rewinds so that the times of the
+// VGM log only go forward.
+type snapshot struct {
+	// Z80
+	A, F, B, C, D, E, H, L         byte
+	A_, F_, B_, C_, D_, E_, H_, L_ byte
+	IXH, IXL, IYH, IYL             byte
+	I, IFF1, IFF2, IM, R7          byte
+	R, SP, PC                      uint16
+	Tstates                        int32
+	Halted                         bool
+
+	// Memory and mapper
+	RAM               [0x2000]byte
+	CartridgeRAM      [0x8000]byte
+	Pages             [4]byte
+	RAMSelectRegister byte
+	Glasses           byte
+	GlassesUsed       bool
+
+	// VDP
+	VRAM                       [0x4000]byte
+	CRAM                       [32]byte
+	Regs                       [16]byte
+	Addr, AddrState, AddrLatch uint16
+	CurrentLine                uint16
+	Status, HCounter           byte
+	HBlankCounter              int32
+	CRAMSelected               bool
+
+	// I/O
+	IOControl byte
+}
+
+// stateSize is the size of the states saved by saveState.
+var stateSize = binary.Size(&snapshot{})
+
+// saveState saves the state of the machine into state, which must be
+// stateSize bytes long, using s to hold it meanwhile.
+func (sms *SMS) saveState(s *snapshot, state []byte) error {
+	cpu, memory, vdp := sms.cpu, sms.memory, sms.vdp
+	*s = snapshot{
+		A: cpu.A, F: cpu.F, B: cpu.B, C: cpu.C, D: cpu.D, E: cpu.E, H: cpu.H, L: cpu.L,
+		A_: cpu.A_, F_: cpu.F_, B_: cpu.B_, C_: cpu.C_, D_: cpu.D_, E_: cpu.E_, H_: cpu.H_, L_: cpu.L_,
+		IXH: cpu.IXH, IXL: cpu.IXL, IYH: cpu.IYH, IYL: cpu.IYL,
+		I: cpu.I, IFF1: cpu.IFF1, IFF2: cpu.IFF2, IM: cpu.IM, R7: cpu.R7,
+		R: cpu.R, SP: cpu.SP(), PC: cpu.PC(),
+		Tstates: int32(cpu.Tstates),
+		Halted:  cpu.Halted,
+
+		RAM:               memory.ram,
+		CartridgeRAM:      memory.cartridgeRam,
+		Pages:             memory.pages,
+		RAMSelectRegister: memory.ramSelectRegister,
+		Glasses:           memory.glasses,
+		GlassesUsed:       memory.glassesUsed,
+
+		Addr:          vdp.addr,
+		AddrState:     vdp.addrState,
+		AddrLatch:     vdp.addrLatch,
+		CurrentLine:   vdp.currentLine,
+		Status:        vdp.status,
+		HCounter:      vdp.hCounter,
+		HBlankCounter: int32(vdp.hBlankCounter),
+		CRAMSelected:  vdp.cramSelected,
+
+		IOControl: sms.ioControl,
+	}
+	copy(s.VRAM[:], vdp.vram)
+	copy(s.CRAM[:], vdp.palette)
+	copy(s.Regs[:], vdp.regs)
+	_, err := binary.Encode(state, binary.LittleEndian, s)
+	return err
+}
+
+// loadState restores a state saved by saveState, using s to hold it
+// meanwhile.
+func (sms *SMS) loadState(s *snapshot, state []byte) error {
+	if _, err := binary.Decode(state, binary.LittleEndian, s); err != nil {
+		return err
+	}
+	cpu, memory, vdp := sms.cpu, sms.memory, sms.vdp
+
+	cpu.A, cpu.F, cpu.B, cpu.C, cpu.D, cpu.E, cpu.H, cpu.L = s.A, s.F, s.B, s.C, s.D, s.E, s.H, s.L
+	cpu.A_, cpu.F_, cpu.B_, cpu.C_, cpu.D_, cpu.E_, cpu.H_, cpu.L_ = s.A_, s.F_, s.B_, s.C_, s.D_, s.E_, s.H_, s.L_
+	cpu.IXH, cpu.IXL, cpu.IYH, cpu.IYL = s.IXH, s.IXL, s.IYH, s.IYL
+	cpu.I, cpu.IFF1, cpu.IFF2, cpu.IM, cpu.R7, cpu.R = s.I, s.IFF1, s.IFF2, s.IM, s.R7, s.R
+	cpu.SetSP(s.SP)
+	cpu.SetPC(s.PC)
+	cpu.Tstates, cpu.Halted = int(s.Tstates), s.Halted
+
+	memory.ram, memory.cartridgeRam = s.RAM, s.CartridgeRAM
+	memory.ramSelectRegister = s.RAMSelectRegister
+	memory.glasses, memory.glassesUsed = s.Glasses, s.GlassesUsed
+	for i := 0; i < 3; i++ {
+		memory.WriteByteInternal(0xfffd+uint16(i), s.Pages[i])
+	}
+
+	copy(vdp.vram, s.VRAM[:])
+	copy(vdp.palette, s.CRAM[:])
+	copy(vdp.regs, s.Regs[:])
+	vdp.addr, vdp.addrState, vdp.addrLatch = s.Addr, s.AddrState, s.AddrLatch
+	vdp.currentLine, vdp.status, vdp.hCounter = s.CurrentLine, s.Status, s.HCounter
+	vdp.hBlankCounter = int(s.HBlankCounter)
+	vdp.cramSelected = s.CRAMSelected
+	if vdp.cramSelected {
+		vdp.writeRoutine, vdp.readRoutine = writePalette, readPalette
+	} else {
+		vdp.writeRoutine, vdp.readRoutine = writeRAM, readRAM
+	}
+
+	sms.writeIOControl(s.IOControl)
+	return nil
+}
@@ -3,24 +3,35 @@ package sms
 var blank_count = 0
 var passed = 0
 
+const (
+	firstDisplayLine = 3 + 13 + 54 // First active line in 192-line mode
+	linesPerFrame    = firstDisplayLine + DISPLAY_HEIGHT + 48 + 3
+)
+
 type vdp struct {
-	vram                         []byte
-	regs                         []byte
-	palette                      []byte
-	paletteR, paletteG, paletteB []byte
-	addr, addrState, addrLatch   uint16
-	currentLine                  uint16
-	status                       byte
-	hBlankCounter                int
-	writeRoutine                 func(*vdp, byte)
-	readRoutine                  func(*vdp) byte
-	displayData                  DisplayData
-	displayLoop                  DisplayLoop
-}
+	vram                       []byte
+	regs                       []byte
+	palette                    []byte
+	addr, addrState, addrLatch uint16
+	currentLine                uint16
+	height                     int
+	lineOffset                 uint16
+	hCounter                   byte
+	status                     byte
+	hBlankCounter              int
+	writeRoutine               func(*vdp, byte)
+	readRoutine                func(*vdp) byte
+	cramSelected               bool // The routines access CRAM
+	displayData                *DisplayData
 
-func (vdp *vdp) updateBorder() {
-	borderIndex := 16 + (vdp.regs[7] & 0xf)
-	vdp.displayLoop.UpdateBorder() <- borderIndex
+	// Sprite unit state for the current line
+	lineSprites    [64]sprite
+	numLineSprites int
+	spriteLine     [DISPLAY_WIDTH]byte
+	priority       [DISPLAY_WIDTH]bool
+	spriteLimit    bool
+
+	phaser *lightPhaser
 }
 
 func (vdp *vdp) writeAddr(val uint16) {
@@ -33,20 +44,17 @@ func (vdp *vdp) writeAddr(val uint16) {
 		case 0, 1:
 			vdp.writeRoutine = writeRAM
 			vdp.readRoutine = readRAM
+			vdp.cramSelected = false
 			vdp.addr = vdp.addrLatch | ((val & 0x3f) << 8)
 			break
 		case 2:
 			regnum := val & 0xf
 			vdp.regs[regnum] = byte(vdp.addrLatch)
-			switch regnum {
-			case 7:
-				vdp.updateBorder()
-				break
-			}
 			break
 		case 3:
 			vdp.writeRoutine = writePalette
 			vdp.readRoutine = readPalette
+			vdp.cramSelected = true
 			vdp.addr = vdp.addrLatch & 0x1f
 			break
 		}
@@ -58,26 +66,11 @@ func writeRAM(vdp *vdp, val byte) {
 	vdp.addr = (vdp.addr + 1) & 0x3fff
 }
 
+// writePalette updates CRAM. The new color is picked up by the next
+// rasterized line, which makes raster palette effects work.
 func writePalette(vdp *vdp, val byte) {
-	r := val & 3
-	r |= r << 2
-	r |= r << 4
-	g := (val >> 2) & 3
-	g |= g << 2
-	g |= g << 4
-	b := (val >> 4) & 3
-	b |= b << 2
-	b |= b << 4
-	vdp.paletteR[vdp.addr] = byte(r)
-	vdp.paletteG[vdp.addr] = byte(g)
-	vdp.paletteB[vdp.addr] = byte(b)
-
-	vdp.displayLoop.WritePalette() <- PaletteValue{byte(vdp.addr), byte(r), byte(g), byte(b)}
-
 	vdp.palette[vdp.addr] = val
 	vdp.addr = (vdp.addr + 1) & 0x1f
-
-	vdp.updateBorder()
 }
 
 func (vdp *vdp) writeByte(val byte) {
@@ -104,104 +97,176 @@ func (vdp *vdp) readByte() byte {
 
 func (vdp *vdp) readStatus() byte {
 	res := vdp.status
-	vdp.status &= 0x3f
+	vdp.status &= 0x1f
 	return res
 }
 
-func (vdp *vdp) findSprites(line int) [][]int {
-	spriteInfo := int(vdp.regs[5]&0x7e) << 7
-	active := make([][]int, 0)
-	spriteHeight := 8
+// tileRows and tileRowsFlipped spread the 8 bits of a bitplane byte
+// over the 8 bytes of a uint64, one byte per pixel with the leftmost
+// pixel in the lowest byte. Combining the four bitplanes of a tile
+// row gives its 8 color indexes at once.
+var tileRows, tileRowsFlipped [256]uint64
+
+func init() {
+	for b := 0; b < 256; b++ {
+		for bit := uint(0); bit < 8; bit++ {
+			if b&(0x80>>bit) != 0 {
+				tileRows[b] |= 1 << (bit * 8)
+				tileRowsFlipped[b] |= 1 << ((7 - bit) * 8)
+			}
+		}
+	}
+}
+
+// decodeTileRow returns the packed color indexes of the tile row
+// stored at addr.
+func (vdp *vdp) decodeTileRow(addr int, table *[256]uint64) uint64 {
+	return table[vdp.vram[addr]] | table[vdp.vram[addr+1]]<<1 | table[vdp.vram[addr+2]]<<2 | table[vdp.vram[addr+3]]<<3
+}
+
+// sprite is an entry of the sprite attribute table selected for
+// the current line.
+type sprite struct {
+	x, y, tile int
+}
+
+// spriteSize returns the height of sprites in lines and their zoom
+// factor.
+func (vdp *vdp) spriteSize() (height int, zoom uint) {
+	height = 8
 	if (vdp.regs[1] & 2) != 0 {
-		spriteHeight = 16
+		height = 16
 	}
+	if (vdp.regs[1] & 1) != 0 {
+		zoom = 1
+	}
+	return height << zoom, zoom
+}
+
+// findSprites selects the sprites displayed on the given line. The
+// ninth sprite sets the overflow flag and, unless the sprite limit
+// is disabled, is dropped along with the following ones.
+func (vdp *vdp) findSprites(line int) {
+	spriteInfo := int(vdp.regs[5]&0x7e) << 7
+	spriteHeight, _ := vdp.spriteSize()
+	vdp.numLineSprites = 0
 	for i := 0; i < 64; i++ {
 		y := int(vdp.vram[spriteInfo+i])
-		if y == 208 {
+		if y == 208 && vdp.height == DISPLAY_HEIGHT {
+			// End of the sprite list, only in 192-line mode.
 			break
 		}
 		if y >= 240 {
 			y -= 256
 		}
+		// Sprites are displayed one line below their Y coordinate.
+		y++
 		if line >= y && line < (y+spriteHeight) {
-			if len(active) == 8 {
+			if vdp.numLineSprites == 8 {
 				vdp.status |= 0x40 // Sprite overflow
-				break
+				if vdp.spriteLimit {
+					break
+				}
+			}
+			x := int(vdp.vram[spriteInfo+128+i*2])
+			if (vdp.regs[0] & 8) != 0 {
+				x -= 8 // Early clock shifts all sprites left
 			}
-			active = append(active, []int{int(vdp.vram[spriteInfo+128+i*2]), int(vdp.vram[spriteInfo+128+i*2+1]), y})
+			vdp.lineSprites[vdp.numLineSprites] = sprite{x, y, int(vdp.vram[spriteInfo+128+i*2+1])}
+			vdp.numLineSprites++
 		}
 	}
-	return active
 }
 
-func (vdp *vdp) rasterizeBackground(lineAddr int, pixelOffset byte, tileData int, tileDef int) {
-	tileVal0 := vdp.vram[tileDef]
-	tileVal1 := vdp.vram[tileDef+1]
-	tileVal2 := vdp.vram[tileDef+2]
-	tileVal3 := vdp.vram[tileDef+3]
-	paletteOffset := byte(0)
-	if (tileData & (1 << 11)) != 0 {
-		paletteOffset = 16
+// rasterizeSprites draws the sprites found for the given line into
+// spriteLine, setting the collision flag whenever two opaque sprite
+// pixels overlap. Sprites earlier in the table have priority.
+// spriteLine is expected to be clear on entry.
+func (vdp *vdp) rasterizeSprites(line int) {
+	vdp.findSprites(line)
+	spriteBase := 0
+	if (vdp.regs[6] & 4) != 0 {
+		spriteBase = 0x2000
 	}
-	if (tileData & (1 << 9)) != 0 {
-		for i := 0; i < 8; i++ {
-			index := (tileVal0 & 1) | ((tileVal1 & 1) << 1) | ((tileVal2 & 1) << 2) | ((tileVal3 & 1) << 3)
-			index += paletteOffset
-			if index != 0 {
-				vdp.displayData[lineAddr+int(pixelOffset)] = index
-			}
-			pixelOffset++
-			tileVal0 >>= 1
-			tileVal1 >>= 1
-			tileVal2 >>= 1
-			tileVal3 >>= 1
+	_, zoom := vdp.spriteSize()
+	for k := 0; k < vdp.numLineSprites; k++ {
+		sprite := &vdp.lineSprites[k]
+		tile := sprite.tile
+		if (vdp.regs[1] & 2) != 0 {
+			tile &= 0xfe // 8x16 sprites start on an even tile
 		}
-	} else {
-		for i := 0; i < 8; i++ {
-			index := ((tileVal0 & 128) >> 7) | ((tileVal1 & 128) >> 6) | ((tileVal2 & 128) >> 5) | ((tileVal3 & 128) >> 4)
-			index += paletteOffset
-			if index != 0 {
-				vdp.displayData[lineAddr+int(pixelOffset)] = index
+		pixels := vdp.decodeTileRow(spriteBase+tile<<5+((line-sprite.y)>>zoom)<<2, &tileRows)
+		if pixels == 0 {
+			continue
+		}
+		for offset := 0; offset < 8<<zoom; offset++ {
+			x := sprite.x + offset
+			if x >= DISPLAY_WIDTH {
+				break // Sprites don't wrap around the right edge
+			}
+			index := byte(pixels >> (uint(offset>>zoom) << 3))
+			if x < 0 || index == 0 {
+				continue
 			}
-			pixelOffset++
-			tileVal0 <<= 1
-			tileVal1 <<= 1
-			tileVal2 <<= 1
-			tileVal3 <<= 1
+			if vdp.spriteLine[x] != 0 {
+				// We have a collision!
+				vdp.status |= 0x20
+				continue
+			}
+			vdp.spriteLine[x] = 16 + index
 		}
 	}
 }
 
-func (vdp *vdp) clearBackground(lineAddr int, pixelOffset byte) {
-	for k := 0; k < 8; k++ {
-		vdp.displayData[lineAddr+int(pixelOffset)] = 0
+// rasterizeBackground draws 8 pixels of a tile line. Pixels of a
+// tile with the priority bit set and a non-zero color are marked
+// as drawn in front of the sprites.
+func (vdp *vdp) rasterizeBackground(lineAddr int, pixelOffset byte, tileData int, tileDef int) {
+	table := &tileRows
+	if (tileData & (1 << 9)) != 0 {
+		table = &tileRowsFlipped
+	}
+	pixels := vdp.decodeTileRow(tileDef, table)
+	paletteOffset := byte(0)
+	if (tileData & (1 << 11)) != 0 {
+		paletteOffset = 16
+	}
+	priority := (tileData & (1 << 12)) != 0
+	for i := 0; i < 8; i++ {
+		index := byte(pixels)
+		vdp.priority[pixelOffset] = priority && index != 0
+		vdp.displayData.Pixels[lineAddr+int(pixelOffset)] = index + paletteOffset
 		pixelOffset++
+		pixels >>= 8
 	}
 }
 
 func (vdp *vdp) rasterizeLine(line int) {
 	lineAddr := line << 8
 
+	// Capture the palette and border as seen by this line.
+	copy(vdp.displayData.Palette[line][:], vdp.palette)
+	vdp.displayData.Border[line] = 16 + (vdp.regs[7] & 0xf)
+
 	if (vdp.regs[1] & 64) == 0 {
 		for i := 0; i < 256; i++ {
-			vdp.displayData[lineAddr+i] = 0
+			vdp.displayData.Pixels[lineAddr+i] = 0
 		}
 		return
 	}
 
 	effectiveLine := line + int(vdp.regs[9])
 
-	if effectiveLine >= 224 {
-		effectiveLine -= 224
-	}
-	sprites := vdp.findSprites(line)
-	spritesLen := len(sprites)
-	spriteBase := 0
-	if (vdp.regs[6] & 4) != 0 {
-		spriteBase = 0x2000
+	if vdp.height == DISPLAY_HEIGHT {
+		if effectiveLine >= 224 {
+			effectiveLine -= 224
+		}
+	} else {
+		effectiveLine &= 0xff
 	}
+	vdp.rasterizeSprites(line)
 	pixelOffset := vdp.regs[8] // * 4
-	nameAddr := ((int(vdp.regs[2]) << 10) & 0x3800) + (effectiveLine>>3)<<6
+	nameAddr := vdp.nameTableAddr() + (effectiveLine>>3)<<6
 	yMod := effectiveLine & 7
 	borderIndex := 16 + (vdp.regs[7] & 0xf)
 
@@ -214,64 +279,68 @@ func (vdp *vdp) rasterizeLine(line int) {
 		} else {
 			tileDef += (yMod << 2)
 		}
-		vdp.clearBackground(lineAddr, pixelOffset)
 		// TODO: static top two rows, and static left-hand rows.
-		if (tileData & (1 << 12)) == 0 {
-			vdp.rasterizeBackground(lineAddr, pixelOffset, tileData, tileDef)
-		}
-		savedOffset := pixelOffset
-		xPos := (i*8 + int(vdp.regs[8])) & 0xff
-		// TODO: sprite X-8 shift
-		for j := 0; j < 8; j++ {
-			writtenTo := false
-			for k := 0; k < spritesLen; k++ {
-				sprite := sprites[k]
-				offset := xPos - sprite[0]
-				if offset < 0 || offset >= 8 {
-					continue
-				}
-				spriteLine := int(line) - int(sprite[2])
-				spriteAddr := int(spriteBase) + int(sprite[1])<<5 + spriteLine<<2
-				effectiveBit := 7 - offset
-				sprVal0 := vdp.vram[spriteAddr]
-				sprVal1 := vdp.vram[spriteAddr+1]
-				sprVal2 := vdp.vram[spriteAddr+2]
-				sprVal3 := vdp.vram[spriteAddr+3]
-				index := ((sprVal0 >> uint(effectiveBit)) & 1) | (((sprVal1 >> uint(effectiveBit)) & 1) << 1) | (((sprVal2 >> uint(effectiveBit)) & 1) << 2) | (((sprVal3 >> uint(effectiveBit)) & 1) << 3)
-				if index == 0 {
-					continue
-				}
-				if writtenTo {
-					// We have a collision!.
-					vdp.status |= 0x20
-					break
+		vdp.rasterizeBackground(lineAddr, pixelOffset, tileData, tileDef)
+		pixelOffset += 8
+	}
+
+	if vdp.numLineSprites > 0 {
+		// Merge the sprites and clear the buffer for the next line.
+		for x := 0; x < DISPLAY_WIDTH; x++ {
+			if index := vdp.spriteLine[x]; index != 0 {
+				if !vdp.priority[x] {
+					vdp.displayData.Pixels[lineAddr+x] = index
 				}
-				vdp.displayData[lineAddr+int(pixelOffset)] = 16 + index
-				writtenTo = true
+				vdp.spriteLine[x] = 0
 			}
-			xPos++
-			pixelOffset++
-		}
-		if (tileData & (1 << 12)) != 0 {
-			vdp.rasterizeBackground(lineAddr, savedOffset, tileData, tileDef)
 		}
 	}
 
 	if (vdp.regs[0] & (1 << 5)) != 0 {
 		// Blank out left hand column.
 		for i := 0; i < 8; i++ {
-			vdp.displayData[lineAddr+i] = borderIndex
+			vdp.displayData.Pixels[lineAddr+i] = borderIndex
 		}
 	}
 }
 
+// displayHeight returns the number of active lines selected by the
+// M1, M2 and M3 bits. The extended heights are only available in
+// Mode 4 with M2 set.
+func (vdp *vdp) displayHeight() int {
+	if (vdp.regs[0]&4) != 0 && (vdp.regs[0]&2) != 0 {
+		if (vdp.regs[1] & 16) != 0 {
+			return DISPLAY_HEIGHT_224
+		}
+		if (vdp.regs[1] & 8) != 0 {
+			return DISPLAY_HEIGHT_240
+		}
+	}
+	return DISPLAY_HEIGHT
+}
+
+// nameTableAddr returns the base address of the name table. In the
+// extended modes the table is 32 rows high and bit 1 of regs[2] is
+// ignored.
+func (vdp *vdp) nameTableAddr() int {
+	if vdp.height == DISPLAY_HEIGHT {
+		return (int(vdp.regs[2]) << 10) & 0x3800
+	}
+	return ((int(vdp.regs[2]) << 10) & 0x3000) | 0x700
+}
+
 func (vdp *vdp) hblank() byte {
 	needIrq := byte(0)
-	firstDisplayLine := 3 + 13 + 54
-	pastEndDisplayLine := firstDisplayLine + 192
-	endOfFrame := pastEndDisplayLine + 48 + 3
-	if int(vdp.currentLine) >= firstDisplayLine && int(vdp.currentLine) < pastEndDisplayLine {
-		vdp.rasterizeLine(int(vdp.currentLine) - firstDisplayLine)
+	if vdp.currentLine == 0 {
+		// Latch the display height for the whole frame.
+		vdp.height = vdp.displayHeight()
+		vdp.lineOffset = uint16(vdp.height-DISPLAY_HEIGHT) / 2
+		vdp.displayData.Height = vdp.height
+	}
+	first := firstDisplayLine - int(vdp.lineOffset)
+	pastEndDisplayLine := first + vdp.height
+	if int(vdp.currentLine) >= first && int(vdp.currentLine) < pastEndDisplayLine {
+		vdp.rasterizeLine(int(vdp.currentLine) - first)
 		vdp.hBlankCounter--
 		if vdp.hBlankCounter < 0 {
 			vdp.hBlankCounter = int(vdp.regs[10])
@@ -281,8 +350,11 @@ func (vdp *vdp) hblank() byte {
 			}
 		}
 	}
+	if vdp.phaser != nil {
+		vdp.phaser.scan(vdp, int(vdp.currentLine)-first)
+	}
 	vdp.currentLine++
-	if int(vdp.currentLine) == endOfFrame {
+	if int(vdp.currentLine) == linesPerFrame {
 		vdp.currentLine = 0
 		vdp.status |= 128
 		if (vdp.regs[1] & 32) != 0 {
@@ -292,17 +364,14 @@ func (vdp *vdp) hblank() byte {
 	return needIrq
 }
 
-func newVDP(displayLoop DisplayLoop) *vdp {
+func newVDP() *vdp {
 	vdp := &vdp{
 		vram:         make([]byte, 0x4000),
 		palette:      make([]byte, 32),
-		paletteR:     make([]byte, 32),
-		paletteG:     make([]byte, 32),
-		paletteB:     make([]byte, 32),
 		regs:         make([]byte, 16),
 		writeRoutine: func(vdp *vdp, b byte) {},
 		readRoutine:  func(vdp *vdp) byte { return 0 },
-		displayLoop:  displayLoop,
+		spriteLimit:  true,
 	}
 	vdp.reset()
 	return vdp
@@ -313,7 +382,7 @@ func (vdp *vdp) reset() {
 		vdp.vram[i] = 0
 	}
 	for i := 0; i < 32; i++ {
-		vdp.paletteR[i], vdp.paletteG[i], vdp.paletteB[i], vdp.palette[i] = 0, 0, 0, 0
+		vdp.palette[i] = 0
 	}
 	for i := 0; i < 16; i++ {
 		vdp.regs[i] = 0
@@ -323,11 +392,12 @@ func (vdp *vdp) reset() {
 	}
 	vdp.regs[6] = 0xfb
 	vdp.regs[10] = 0xff
-	vdp.currentLine, vdp.status, vdp.hBlankCounter = 0, 0, 0
+	vdp.currentLine, vdp.status, vdp.hBlankCounter, vdp.hCounter = 0, 0, 0, 0
+	vdp.height, vdp.lineOffset = DISPLAY_HEIGHT, 0
 }
 
 func (vdp *vdp) getLine() uint16 {
-	return (vdp.currentLine - 64) & 0xff
+	return (vdp.currentLine + vdp.lineOffset - 64) & 0xff
 }
 
 func (vdp *vdp) dumpSprites() {
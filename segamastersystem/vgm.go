@@ -0,0 +1,190 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	CPU_CLOCK       = 3546893 // PAL Z80, PSG and YM2413 clock in Hz
+	VGM_SAMPLE_RATE = 44100
+	vgmHeaderSize   = 0x40
+)
+
+// VGMLogger logs the writes to the PSG, to the Game Gear stereo
+// register and to the YM2413 into a VGM file. The time between
+// writes is derived from the emulated cycles.
+type VGMLogger struct {
+	filename, gameName string
+	data               bytes.Buffer
+	startCycles        uint64
+	samples            uint64 // Samples written so far
+	loopOffset         int    // Offset of the loop point in data, -1 if none
+	loopSamples        uint64
+	ymUsed             bool
+	ymAddress          byte
+}
+
+// NewVGMLogger returns a logger which will write into filename when
+// closed. gameName is stored in the GD3 tag. cycles is the current
+// count of emulated cycles.
+func NewVGMLogger(filename, gameName string, cycles uint64) *VGMLogger {
+	return &VGMLogger{
+		filename:    filename,
+		gameName:    gameName,
+		startCycles: cycles,
+		loopOffset:  -1,
+	}
+}
+
+// wait emits the wait commands up to the given cycle count.
+func (l *VGMLogger) wait(cycles uint64) {
+	if cycles < l.startCycles {
+		return
+	}
+	target := (cycles - l.startCycles) * VGM_SAMPLE_RATE / CPU_CLOCK
+	for l.samples < target {
+		n := target - l.samples
+		switch {
+		case n == 882:
+			l.data.WriteByte(0x63) // Wait 1/50 second
+		case n == 735:
+			l.data.WriteByte(0x62) // Wait 1/60 second
+		default:
+			if n > 0xffff {
+				n = 0xffff
+			}
+			l.data.WriteByte(0x61)
+			binary.Write(&l.data, binary.LittleEndian, uint16(n))
+		}
+		l.samples += n
+	}
+}
+
+// psgWrite logs a write to the SN76489.
+func (l *VGMLogger) psgWrite(val byte, cycles uint64) {
+	l.wait(cycles)
+	l.data.Write([]byte{0x50, val})
+}
+
+// stereoWrite logs a write to the Game Gear stereo register.
+func (l *VGMLogger) stereoWrite(val byte, cycles uint64) {
+	l.wait(cycles)
+	l.data.Write([]byte{0x4f, val})
+}
+
+// ymAddressWrite latches the YM2413 register written next.
+func (l *VGMLogger) ymAddressWrite(val byte) {
+	l.ymAddress = val
+}
+
+// ymDataWrite logs a write to the latched YM2413 register.
+func (l *VGMLogger) ymDataWrite(val byte, cycles uint64) {
+	l.wait(cycles)
+	l.ymUsed = true
+	l.data.Write([]byte{0x51, l.ymAddress, val})
+}
+
+// MarkLoop sets the point the music loops back to.
+func (l *VGMLogger) MarkLoop(cycles uint64) {
+	l.wait(cycles)
+	l.loopOffset = l.data.Len()
+	l.loopSamples = l.samples
+}
+
+// gd3 returns the GD3 tag of the file.
+func (l *VGMLogger) gd3() []byte {
+	var text bytes.Buffer
+	// Track, game, system and author names in English and
+	// Japanese, followed by release date, creator and notes.
+	for _, s := range []string{"", "", l.gameName, "", "Sega Master System", "", "", "", "", "SMS", ""} {
+		for _, c := range utf16.Encode([]rune(s)) {
+			binary.Write(&text, binary.LittleEndian, c)
+		}
+		binary.Write(&text, binary.LittleEndian, uint16(0))
+	}
+	var tag bytes.Buffer
+	tag.WriteString("Gd3 ")
+	binary.Write(&tag, binary.LittleEndian, uint32(0x100))
+	binary.Write(&tag, binary.LittleEndian, uint32(text.Len()))
+	tag.Write(text.Bytes())
+	return tag.Bytes()
+}
+
+// Close terminates the log at the given cycle count and writes the
+// VGM file.
+func (l *VGMLogger) Close(cycles uint64) error {
+	l.wait(cycles)
+	l.data.WriteByte(0x66) // End of sound data
+	gd3 := l.gd3()
+	gd3Offset := vgmHeaderSize + l.data.Len()
+
+	header := make([]byte, vgmHeaderSize)
+	le := binary.LittleEndian
+	copy(header, "Vgm ")
+	le.PutUint32(header[0x04:], uint32(gd3Offset+len(gd3)-0x04))
+	le.PutUint32(header[0x08:], 0x150)
+	le.PutUint32(header[0x0c:], CPU_CLOCK)
+	if l.ymUsed {
+		le.PutUint32(header[0x10:], CPU_CLOCK)
+	}
+	le.PutUint32(header[0x14:], uint32(gd3Offset-0x14))
+	le.PutUint32(header[0x18:], uint32(l.samples))
+	if l.loopOffset >= 0 {
+		le.PutUint32(header[0x1c:], uint32(vgmHeaderSize+l.loopOffset-0x1c))
+		le.PutUint32(header[0x20:], uint32(l.samples-l.loopSamples))
+	}
+	le.PutUint32(header[0x24:], 50)
+	le.PutUint16(header[0x28:], 0x0009) // SN76489 feedback pattern
+	header[0x2a] = 16                   // SN76489 shift register width
+	le.PutUint32(header[0x34:], vgmHeaderSize-0x34)
+
+	f, err := os.Create(l.filename)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range [][]byte{header, l.data.Bytes(), gd3} {
+		if _, err := f.Write(chunk); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// StartVGMLog starts logging the sound chip writes into filename.
+func (sms *SMS) StartVGMLog(filename string) error {
+	if sms.vgm != nil {
+		return fmt.Errorf("VGM logging already in progress")
+	}
+	gameName := strings.TrimSuffix(filepath.Base(sms.romName), filepath.Ext(sms.romName))
+	sms.vgm = NewVGMLogger(filename, gameName, sms.Cycles())
+	return nil
+}
+
+// StopVGMLog stops logging and writes the VGM file.
+func (sms *SMS) StopVGMLog() error {
+	if sms.vgm == nil {
+		return fmt.Errorf("VGM logging not in progress")
+	}
+	err := sms.vgm.Close(sms.Cycles())
+	sms.vgm = nil
+	return err
+}
+
+// VGMLogging returns true if sound chip writes are being logged.
+func (sms *SMS) VGMLogging() bool {
+	return sms.vgm != nil
+}
+
+// MarkVGMLoop sets the loop point of the VGM file being logged.
+func (sms *SMS) MarkVGMLoop() {
+	if sms.vgm != nil {
+		sms.vgm.MarkLoop(sms.Cycles())
+	}
+}
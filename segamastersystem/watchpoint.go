@@ -0,0 +1,206 @@
+package sms
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Conditions of the watchpoints.
+const (
+	WATCH_ANY     = iota // Every access
+	WATCH_EQUALS         // Accesses of a given value
+	WATCH_CHANGED        // Accesses of a value other than the previous one
+)
+
+// Watchpoint stops the emulation, or logs the PC and cycle count,
+// when the CPU accesses a memory address or an I/O port, through any
+// of its mirrors. The mapper registers are watched as the memory
+// addresses 0xfffc-0xffff.
+type Watchpoint struct {
+	Port        bool // An I/O port rather than a memory address
+	Address     uint16
+	Read, Write bool
+	Condition   int
+	Value       byte // Compared with WATCH_EQUALS
+	Log         bool // Log the accesses instead of stopping
+	last        int  // Previous value accessed, -1 if unknown
+}
+
+// ParseWatchpoint parses a watchpoint of the form
+//
+//	[port] addr [r|w|rw] [=value|changed] [log]
+//
+// with the fields separated by spaces or colons and the numbers in
+// hexadecimal. Writes are watched by default.
+func ParseWatchpoint(spec string) (*Watchpoint, error) {
+	fields := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ' ' || r == ':'
+	})
+	w := &Watchpoint{Write: true, last: -1}
+	if len(fields) > 0 && fields[0] == "port" {
+		w.Port = true
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing address")
+	}
+	var err error
+	if w.Address, err = ParseAddress(fields[0]); err != nil {
+		return nil, err
+	}
+	if w.Port && w.Address > 0xff {
+		return nil, fmt.Errorf("invalid port %q", fields[0])
+	}
+	w.Address = watchAddress(w.Port, w.Address)
+	for _, field := range fields[1:] {
+		switch {
+		case field == "r", field == "w", field == "rw":
+			w.Read = strings.Contains(field, "r")
+			w.Write = strings.Contains(field, "w")
+		case field == "changed":
+			w.Condition = WATCH_CHANGED
+		case field == "log":
+			w.Log = true
+		case strings.HasPrefix(field, "="):
+			value, err := strconv.ParseUint(strings.TrimLeft(field, "="), 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", field)
+			}
+			w.Condition, w.Value = WATCH_EQUALS, byte(value)
+		default:
+			return nil, fmt.Errorf("unknown watchpoint field %q", field)
+		}
+	}
+	return w, nil
+}
+
+func (w *Watchpoint) String() string {
+	s := fmt.Sprintf("0x%04x", w.Address)
+	if w.Port {
+		s = fmt.Sprintf("port 0x%02x", w.Address)
+	}
+	switch {
+	case w.Read && w.Write:
+		s += " rw"
+	case w.Read:
+		s += " r"
+	default:
+		s += " w"
+	}
+	switch w.Condition {
+	case WATCH_EQUALS:
+		s += fmt.Sprintf(" =%02x", w.Value)
+	case WATCH_CHANGED:
+		s += " changed"
+	}
+	if w.Log {
+		s += " log"
+	}
+	return s
+}
+
+// watchAddress returns the address a memory address or a port is
+// watched as, the same for all its mirrors. Only matching uses it, the
+// ports themselves are decoded by Ports.
+func watchAddress(port bool, address uint16) uint16 {
+	switch {
+	case port:
+		return uint16(portMirror(byte(address)))
+	case address >= 0xc000 && address < 0xfffc:
+		return 0xc000 | address&0x1fff // RAM
+	}
+	return address
+}
+
+// portMirror returns the port of which p is a mirror. Only a few
+// address lines are decoded, so most ports are mirrored over a range.
+func portMirror(p byte) byte {
+	switch {
+	case p < 0x40:
+		return 0x3e | p&1 // Memory and I/O control
+	case p < 0x80:
+		return 0x7e | p&1 // Counters and PSG
+	case p < 0xc0:
+		return 0xbe | p&1 // VDP data and control
+	case p == 0xde, p == 0xdf, p >= 0xf0 && p <= 0xf2:
+		return p // Unknown use and YM2413
+	}
+	return 0xdc | p&1 // I/O ports A and B
+}
+
+// matches returns whether an access of value triggers the
+// watchpoint. previous is the value replaced by a memory write, -1
+// otherwise.
+func (w *Watchpoint) matches(value byte, previous int) bool {
+	if previous < 0 {
+		previous = w.last
+	}
+	w.last = int(value)
+	switch w.Condition {
+	case WATCH_EQUALS:
+		return value == w.Value
+	case WATCH_CHANGED:
+		return previous >= 0 && int(value) != previous
+	}
+	return true
+}
+
+// Watch adds a watchpoint to the debugger.
+func (d *Debugger) Watch(w *Watchpoint) {
+	d.watchpoints = append(d.watchpoints, w)
+}
+
+// access is called on the memory and port accesses of the CPU while
+// there are watchpoints.
+func (d *Debugger) access(port bool, address uint16, value byte, write bool, previous int) {
+	watched := watchAddress(port, address)
+	for _, w := range d.watchpoints {
+		if w.Port != port || w.Address != watched || !(write && w.Write || !write && w.Read) {
+			continue
+		}
+		if !w.matches(value, previous) {
+			continue
+		}
+		kind, location := "Read 0x%02x from %s", fmt.Sprintf("0x%04x", address)
+		if write {
+			kind = "Write 0x%02x to %s"
+		}
+		if port {
+			location = fmt.Sprintf("port 0x%02x", address)
+		}
+		// The PC of the instruction being executed
+		pc := d.sms.cpu.PC()
+		if d.executed > 0 {
+			pc = d.history[(d.executed-1)%DEBUGGER_HISTORY]
+		}
+		message := fmt.Sprintf(kind+" by 0x%04x at cycle %d", value, location, pc, d.sms.Cycles())
+		if w.Log {
+			fmt.Fprintln(d.out, message)
+		} else {
+			// Stop once the instruction is completed
+			d.watchHit = message
+		}
+	}
+}
+
+// watch is called on the memory accesses of the CPU, before writes
+// are done.
+func (memory *Memory) watch(address uint16, value byte, write bool) {
+	d := memory.debugger
+	if d == nil || len(d.watchpoints) == 0 {
+		return
+	}
+	previous := -1
+	if write {
+		previous = int(memory.ReadByteInternal(address))
+	}
+	d.access(false, address, value, write, previous)
+}
+
+// watch is called on the port accesses of the CPU.
+func (p *Ports) watch(address uint16, value byte, write bool) {
+	if d := p.sms.debugger; d != nil && len(d.watchpoints) > 0 {
+		d.access(true, address&0xff, value, write, -1)
+	}
+}
@@ -0,0 +1,66 @@
+package z80
+
+import (
+	smslib "github.com/remogatto/sms/segamastersystem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigOverridesDefaults(t *testing.T) {
+	config := smslib.DefaultConfig()
+	path := writeConfig(t, `{"joypad1": {"fire1": "a"}, "hotkeys": {"pause": "space"}}`)
+	if err := config.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if key := config.Joypad1["fire1"]; key != "a" {
+		t.Errorf("fire1 bound to %q, want a", key)
+	}
+	if key := config.Joypad1["up"]; key != "up" {
+		t.Errorf("up bound to %q, want the default", key)
+	}
+	if key := config.Hotkeys[smslib.HOTKEY_PAUSE]; key != "space" {
+		t.Errorf("pause bound to %q, want space", key)
+	}
+}
+
+func TestConfigRejectsUnknownNames(t *testing.T) {
+	for _, content := range []string{
+		`{"joypad1": {"fire3": "a"}}`,
+		`{"joypad2": {"reset": "a"}}`,
+		`{"gamepad": {"trigger": "fire1"}}`,
+		`{"gamepad": {"button0": "start"}}`,
+		`{"console": {"power": "p"}}`,
+		`{"hotkeys": {"explode": "e"}}`,
+	} {
+		if err := smslib.DefaultConfig().Load(writeConfig(t, content)); err == nil {
+			t.Errorf("%s: expected an error", content)
+		}
+	}
+}
+
+func TestConfigRejectsKeysBoundTwice(t *testing.T) {
+	for _, content := range []string{
+		`{"hotkeys": {"pause": "f12"}}`,
+		`{"hotkeys": {"rewind": "z"}}`,
+		`{"hotkeys": {"turbo": "k"}}`,
+		`{"console": {"reset": "p"}}`,
+	} {
+		if err := smslib.DefaultConfig().Load(writeConfig(t, content)); err == nil {
+			t.Errorf("%s: expected an error", content)
+		}
+	}
+	// Swapping two keys is fine, and so is a key pressing two buttons
+	path := writeConfig(t, `{"hotkeys": {"pause": "f12", "screenshot": "p"}, "joypad1": {"fire1": "x"}}`)
+	if err := smslib.DefaultConfig().Load(path); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,38 @@
+package z80
+
+import (
+	smslib "github.com/remogatto/sms/segamastersystem"
+	"testing"
+)
+
+func TestConnectOnePhaser(t *testing.T) {
+	sms := smslib.NewSMS()
+	if err := sms.Connect(1, smslib.DEVICE_PHASER); err != nil {
+		t.Fatal(err)
+	}
+	if err := sms.Connect(2, smslib.DEVICE_PHASER); err == nil {
+		t.Error("a second Light Phaser was connected")
+	}
+	// Replacing the phaser is fine
+	if err := sms.Connect(1, smslib.DEVICE_PHASER); err != nil {
+		t.Error(err)
+	}
+	if err := sms.Connect(1, smslib.DEVICE_JOYPAD); err != nil {
+		t.Fatal(err)
+	}
+	if err := sms.Connect(2, smslib.DEVICE_PHASER); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMouseDevices(t *testing.T) {
+	sms := smslib.NewSMS()
+	if devices := sms.MouseDevices(); devices != 0 {
+		t.Errorf("joypads use the mouse: %d", devices)
+	}
+	sms.Connect(1, smslib.DEVICE_PHASER)
+	sms.Connect(2, smslib.DEVICE_PADDLE)
+	if devices := sms.MouseDevices(); devices != smslib.MOUSE_AIM|smslib.MOUSE_MOTION {
+		t.Errorf("phaser and paddle use the mouse as %d", devices)
+	}
+}
@@ -0,0 +1,36 @@
+package z80
+
+import (
+	"bytes"
+	smslib "github.com/remogatto/sms/segamastersystem"
+	"strings"
+	"testing"
+)
+
+func TestDebuggerStopsAtBreakpointAndSteps(t *testing.T) {
+	var out bytes.Buffer
+	debugger := smslib.NewDebugger(strings.NewReader("step\nregs\ncontinue\n"), &out)
+	debugger.SetBreakpoint(0x0000)
+	sms := smslib.NewSMS()
+	sms.LoadROM("../roms/blockhead.sms")
+	sms.AttachDebugger(debugger)
+	sms.RenderFrame().Release()
+	for _, want := range []string{"Breakpoint at 0x0000", "Step at 0x", "PC="} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("debugger output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	for _, s := range []string{"38", "0x38", "0X38", "$38", " 0x0038 "} {
+		if address, err := smslib.ParseAddress(s); err != nil || address != 0x38 {
+			t.Errorf("%q parsed as 0x%04x, %v", s, address, err)
+		}
+	}
+	for _, s := range []string{"", "0x", "10000", "zz"} {
+		if _, err := smslib.ParseAddress(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
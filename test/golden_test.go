@@ -0,0 +1,212 @@
+package z80
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	smslib "github.com/remogatto/sms/segamastersystem"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate the golden hashes and frames")
+
+const (
+	goldenFrames = 600 // Number of frames emulated for each ROM
+	goldenEvery  = 30  // Interval between checked frames
+)
+
+// goldenCase is a ROM run for goldenFrames frames, optionally with
+// scripted input. The hashes of a required case must be committed.
+type goldenCase struct {
+	name, rom, input string
+	required         bool
+}
+
+// goldenCases returns the bundled ROM along with the ROMs placed in
+// testdata/roms. The input script of a ROM, if any, is read from
+// testdata/input/<name>.txt.
+func goldenCases() []goldenCase {
+	cases := []goldenCase{{name: "blockhead", rom: "../roms/blockhead.sms", required: true}}
+	roms, _ := filepath.Glob(filepath.Join("testdata", "roms", "*.sms"))
+	for _, rom := range roms {
+		name := strings.TrimSuffix(filepath.Base(rom), filepath.Ext(rom))
+		cases = append(cases, goldenCase{name: name, rom: rom})
+	}
+	for i := range cases {
+		input := filepath.Join("testdata", "input", cases[i].name+".txt")
+		if _, err := os.Stat(input); err == nil {
+			cases[i].input = input
+		}
+	}
+	return cases
+}
+
+func (c goldenCase) hashFile() string {
+	return filepath.Join("testdata", "golden", c.name+".txt")
+}
+
+func (c goldenCase) frameFile(dir string, frame int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%05d.png", c.name, frame))
+}
+
+// run emulates the case and returns a copy of the checked frames.
+func (c goldenCase) run(t *testing.T) map[int]*smslib.DisplayData {
+	script := &smslib.InputScript{}
+	if c.input != "" {
+		f, err := os.Open(c.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script, err = smslib.ReadInputScript(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", c.input, err)
+		}
+	}
+	sms := smslib.NewSMS()
+	sms.LoadROM(c.rom)
+	frames := make(map[int]*smslib.DisplayData)
+	for frame := 1; frame <= goldenFrames; frame++ {
+		script.Apply(sms, frame)
+		data := sms.RenderFrame()
+		if frame%goldenEvery == 0 {
+			frames[frame] = new(smslib.DisplayData)
+			*frames[frame] = *data
+		}
+		data.Release()
+	}
+	return frames
+}
+
+func readGoldenHashes(filename string) (map[int]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hashes := make(map[int]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		frame, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid frame %q", filename, fields[0])
+		}
+		hashes[frame] = fields[1]
+	}
+	return hashes, scanner.Err()
+}
+
+func writeGolden(t *testing.T, c goldenCase, frames map[int]*smslib.DisplayData) {
+	if err := os.MkdirAll(filepath.Dir(c.hashFile()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(c.hashFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for frame := goldenEvery; frame <= goldenFrames; frame += goldenEvery {
+		fmt.Fprintf(f, "%d %s\n", frame, frames[frame].Hash())
+		if err := frames[frame].WritePNG(c.frameFile(filepath.Dir(c.hashFile()), frame), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// diffImage returns an image showing in red the pixels that differ
+// between expected and actual, over a dimmed copy of actual.
+func diffImage(expected, actual image.Image) *image.RGBA {
+	bounds := expected.Bounds().Union(actual.Bounds())
+	diff := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p := image.Pt(x, y)
+			er, eg, eb, ea := expected.At(x, y).RGBA()
+			ar, ag, ab, aa := actual.At(x, y).RGBA()
+			if !p.In(expected.Bounds()) || !p.In(actual.Bounds()) || er != ar || eg != ag || eb != ab || ea != aa {
+				diff.SetRGBA(x, y, color.RGBA{0xff, 0, 0, 0xff})
+			} else {
+				diff.SetRGBA(x, y, color.RGBA{uint8(ar >> 10), uint8(ag >> 10), uint8(ab >> 10), 0xff})
+			}
+		}
+	}
+	return diff
+}
+
+func writePNG(filename string, img image.Image) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reportMismatch saves the actual frame and, when the golden frame is
+// available, a diff against it into testdata/failures.
+func reportMismatch(t *testing.T, c goldenCase, frame int, data *smslib.DisplayData) {
+	dir := filepath.Join("testdata", "failures")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	actual := data.Image(false)
+	if err := writePNG(c.frameFile(dir, frame), actual); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(c.frameFile(filepath.Dir(c.hashFile()), frame))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	expected, err := png.Decode(f)
+	if err != nil {
+		return
+	}
+	diffFile := filepath.Join(dir, fmt.Sprintf("%s-%05d-diff.png", c.name, frame))
+	if err := writePNG(diffFile, diffImage(expected, actual)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for _, c := range goldenCases() {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			frames := c.run(t)
+			if *update {
+				writeGolden(t, c, frames)
+				return
+			}
+			golden, err := readGoldenHashes(c.hashFile())
+			if os.IsNotExist(err) && c.required {
+				t.Fatalf("no golden hashes in %s, run the tests with -update and commit them", c.hashFile())
+			}
+			if os.IsNotExist(err) {
+				t.Skipf("no golden hashes in %s, run the tests with -update", c.hashFile())
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for frame := goldenEvery; frame <= goldenFrames; frame += goldenEvery {
+				if hash := frames[frame].Hash(); hash != golden[frame] {
+					t.Errorf("frame %d: got hash %s, want %s", frame, hash, golden[frame])
+					reportMismatch(t, c, frame, frames[frame])
+				}
+			}
+		})
+	}
+}
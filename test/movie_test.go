@@ -0,0 +1,40 @@
+package z80
+
+import (
+	"bytes"
+	smslib "github.com/remogatto/sms/segamastersystem"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMovieRoundTrip(t *testing.T) {
+	movie := &smslib.Movie{
+		ROM:    "0123456789abcdef0123456789abcdef01234567",
+		Frames: 100,
+		Events: []smslib.InputEvent{
+			{Frame: 3, Value: smslib.JOYPAD1_FIRE1, Event: smslib.JOYPAD_DOWN},
+			{Frame: 7, Value: smslib.JOYPAD1_FIRE1, Event: smslib.JOYPAD_UP},
+			{Frame: 7, Value: smslib.JOYPAD2_LEFT | smslib.RESET_BUTTON, Event: smslib.JOYPAD_DOWN},
+		},
+		Hashes: map[int]string{50: "a", 100: "b"},
+	}
+	var buf bytes.Buffer
+	if err := movie.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := smslib.ReadMovie(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, movie) {
+		t.Errorf("got %+v, want %+v", read, movie)
+	}
+}
+
+func TestMovieRejectsUnknownStart(t *testing.T) {
+	_, err := smslib.ReadMovie(strings.NewReader(smslib.MOVIE_HEADER + "\nstart savestate\n"))
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,52 @@
+package z80
+
+import (
+	smslib "github.com/remogatto/sms/segamastersystem"
+	"testing"
+)
+
+func newHeadlessSMS() *smslib.SMS {
+	sms := smslib.NewSMS()
+	sms.LoadROM("../roms/blockhead.sms")
+	// Let the game set up the VDP before measuring.
+	for i := 0; i < 100; i++ {
+		sms.RenderFrame().Release()
+	}
+	return sms
+}
+
+func TestRenderFrameDoesNotAllocate(t *testing.T) {
+	sms := newHeadlessSMS()
+	allocs := testing.AllocsPerRun(50, func() {
+		sms.RenderFrame().Release()
+	})
+	if allocs != 0 {
+		t.Errorf("RenderFrame allocates %.1f times per frame, want 0", allocs)
+	}
+}
+
+// BenchmarkRenderFrame measures the emulation of a frame of
+// blockhead. For reference, on an AMD EPYC it went from 202000 ns/op
+// to 162000 ns/op when the tiles were decoded through lookup tables.
+func BenchmarkRenderFrame(b *testing.B) {
+	sms := newHeadlessSMS()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sms.RenderFrame().Release()
+	}
+}
+
+func TestFramePoolReusesReleasedFrames(t *testing.T) {
+	pool := smslib.NewFramePool(2)
+	first, second := pool.Get(), pool.Get()
+	if first == second {
+		t.Fatal("pool handed out the same frame twice")
+	}
+	copied := *first
+	copied.Release() // Copies don't belong to the pool
+	first.Release()
+	if frame := pool.Get(); frame != first {
+		t.Errorf("expected the released frame to be reused")
+	}
+}
@@ -0,0 +1,89 @@
+package z80
+
+import (
+	"bytes"
+	smslib "github.com/remogatto/sms/segamastersystem"
+	"strings"
+	"testing"
+)
+
+func TestRewindReplaysSavedFrames(t *testing.T) {
+	sms := newHeadlessSMS()
+	sms.EnableRewind(smslib.REWIND_BUFFER_SIZE)
+	hashes := make(map[int]string)
+	for frame := 1; frame <= 4*smslib.REWIND_INTERVAL; frame++ {
+		data := sms.RenderFrame()
+		hashes[frame] = data.Hash()
+		data.Release()
+	}
+	// States are saved every REWIND_INTERVAL frames, the last one
+	// being the current state.
+	for _, saved := range []int{3, 2, 1} {
+		data := sms.Rewind()
+		if data == nil {
+			t.Fatalf("no state saved after frame %d", saved*smslib.REWIND_INTERVAL)
+		}
+		want := hashes[saved*smslib.REWIND_INTERVAL+1]
+		if got := data.Hash(); got != want {
+			t.Errorf("rewinding to frame %d rendered %s, want %s", saved*smslib.REWIND_INTERVAL, got, want)
+		}
+		data.Release()
+	}
+	if data := sms.Rewind(); data != nil {
+		t.Error("rewound past the oldest saved state")
+	}
+}
+
+// Rewound frames were logged when first played, so the watchpoints
+// must not log them again.
+func TestRewindSuspendsLogging(t *testing.T) {
+	sms := newHeadlessSMS()
+	sms.EnableRewind(smslib.REWIND_BUFFER_SIZE)
+	var out bytes.Buffer
+	debugger := smslib.NewDebugger(strings.NewReader(""), &out)
+	w, err := smslib.ParseWatchpoint("port bf w log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugger.Watch(w)
+	sms.AttachDebugger(debugger)
+	for frame := 0; frame < 2*smslib.REWIND_INTERVAL; frame++ {
+		sms.RenderFrame().Release()
+	}
+	if out.Len() == 0 {
+		t.Fatal("the VDP was never written to")
+	}
+	out.Reset()
+	cycles := sms.Cycles()
+	sms.Rewind().Release()
+	if out.Len() != 0 {
+		t.Errorf("rewinding logged:\n%s", out.String())
+	}
+	if sms.Cycles() < cycles {
+		t.Errorf("rewinding took the cycles back from %d to %d", cycles, sms.Cycles())
+	}
+	sms.RenderFrame().Release()
+	if out.Len() == 0 {
+		t.Error("the watchpoint was not restored after rewinding")
+	}
+}
+
+// Saving a state allocates at most the delta kept, when no spare one
+// left by a rewind or dropped from the full buffer fits.
+func TestSavingRewindStatesReusesBuffers(t *testing.T) {
+	sms := newHeadlessSMS()
+	sms.EnableRewind(smslib.REWIND_BUFFER_SIZE)
+	for frame := 0; frame < 4*smslib.REWIND_INTERVAL; frame++ {
+		sms.RenderFrame().Release()
+	}
+	sms.Rewind().Release()
+	sms.Rewind().Release()
+	allocs := testing.AllocsPerRun(10, func() {
+		for frame := 0; frame < smslib.REWIND_INTERVAL; frame++ {
+			sms.RenderFrame().Release()
+		}
+	})
+	if allocs > 1 {
+		t.Errorf("saving a rewind state allocates %.1f times, want at most 1", allocs)
+	}
+}
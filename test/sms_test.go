@@ -17,15 +17,17 @@ func BenchmarkRendering(b *testing.B) {
 	displayLoop := smslib.NewSDLLoop(screen)
 	go displayLoop.Run()
 
-	sms := smslib.NewSMS(displayLoop)
+	sms := smslib.NewSMS()
 
 	sms.LoadROM("../roms/blockhead.sms")
 	
 	numOfGeneratedFrames := 100
-	generatedFrames := make([]smslib.DisplayData, numOfGeneratedFrames)
+	generatedFrames := make([]smslib.DisplayData, 0, numOfGeneratedFrames)
 
 	for i := 0; i < numOfGeneratedFrames; i++ {
-		generatedFrames = append(generatedFrames, *sms.RenderFrame())
+		frame := sms.RenderFrame()
+		generatedFrames = append(generatedFrames, *frame)
+		frame.Release()
 	}
 	
 	b.ResetTimer()
@@ -37,21 +39,12 @@ func BenchmarkRendering(b *testing.B) {
 }
 
 func BenchmarkCPU(b *testing.B) {
-	if sdl.Init(sdl.INIT_EVERYTHING) != 0 {
-		log.Fatal(sdl.GetError())
-	}
-
-	screen := smslib.NewSDL2xScreen(false)
-
-	displayLoop := smslib.NewSDLLoop(screen)
-	go displayLoop.Run()
-
-	sms := smslib.NewSMS(displayLoop)
+	sms := smslib.NewSMS()
 
 	sms.LoadROM("../roms/blockhead.sms")
 	
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		sms.RenderFrame()
+		sms.RenderFrame().Release()
 	}
 }
@@ -0,0 +1,273 @@
+package z80
+
+import (
+	"bytes"
+	"fmt"
+	smslib "github.com/remogatto/sms/segamastersystem"
+	"strings"
+	"testing"
+)
+
+const (
+	spriteTable    = 0x3f00 // Sprite attribute table selected by register 5
+	spriteDataBase = 0x1000 // Where the VRAM contents are placed in the test ROM
+)
+
+// spriteEntry is an entry of the sprite attribute table.
+type spriteEntry struct {
+	x, y, tile byte
+}
+
+// vramWrite is data written into VRAM at addr.
+type vramWrite struct {
+	addr uint16
+	data []byte
+}
+
+// spriteTile returns an 8x8 tile whose rows all have the given
+// colors, from left to right.
+func spriteTile(colors ...byte) []byte {
+	var row [4]byte
+	for x, color := range colors {
+		for plane := range row {
+			if color&(1<<uint(plane)) != 0 {
+				row[plane] |= 0x80 >> uint(x)
+			}
+		}
+	}
+	return bytes.Repeat(row[:], 8)
+}
+
+// solidTile returns an 8x8 tile of a single color.
+func solidTile(color byte) []byte {
+	return spriteTile(color, color, color, color, color, color, color, color)
+}
+
+// spriteAttributes returns the sprite attribute table holding the
+// given sprites, the list being terminated by Y = 208.
+func spriteAttributes(sprites ...spriteEntry) vramWrite {
+	table := make([]byte, 256)
+	for i, s := range sprites {
+		table[i] = s.y
+		table[128+2*i], table[128+2*i+1] = s.x, s.tile
+	}
+	table[len(sprites)] = 208
+	return vramWrite{spriteTable, table}
+}
+
+// vdpROM returns a ROM which sets the VDP registers, register 1 last,
+// and writes into VRAM. It then reads the status register once the
+// display is over, and again after the display of every frame that
+// follows.
+func vdpROM(t *testing.T, regs [11]byte, writes ...vramWrite) string {
+	rom := []byte{0xf3} // di
+	setRegister := func(r int) {
+		// ld a,value; out (0xbf),a; ld a,0x80|r; out (0xbf),a
+		rom = append(rom, 0x3e, regs[r], 0xd3, 0xbf, 0x3e, 0x80|byte(r), 0xd3, 0xbf)
+	}
+	for r := range regs {
+		if r != 1 {
+			setRegister(r)
+		}
+	}
+	var data []byte
+	for _, w := range writes {
+		for offset := 0; offset < len(w.data); offset += 256 {
+			chunk := w.data[offset:]
+			if len(chunk) > 256 {
+				chunk = chunk[:256]
+			}
+			addr := w.addr + uint16(offset)
+			src := spriteDataBase + len(data)
+			data = append(data, chunk...)
+			rom = append(rom,
+				0x3e, byte(addr), 0xd3, 0xbf, // ld a,addr; out (0xbf),a
+				0x3e, byte(addr>>8)|0x40, 0xd3, 0xbf, // ld a,0x40|addr>>8; out (0xbf),a
+				0x21, byte(src), byte(src>>8), // ld hl,src
+				0x0e, 0xbe, // ld c,0xbe
+				0x06, byte(len(chunk)), // ld b,len
+				0xed, 0xb3, // otir
+			)
+		}
+	}
+	setRegister(1)
+	rom = append(rom,
+		0xdb, 0x7e, 0xfe, 0xc8, 0x20, 0xfa, // wait for line 0xc8
+		0xdb, 0xbf, // in a,(0xbf)
+		0xdb, 0x7e, 0xfe, 0x10, 0x20, 0xfa, // wait for line 0x10 of the next frame
+		0xdb, 0x7e, 0xfe, 0xc8, 0x20, 0xfa, // wait for line 0xc8
+		0xdb, 0xbf, // in a,(0xbf)
+		0x18, 0xf0, // jr to the wait for line 0x10
+	)
+	if len(rom) > spriteDataBase {
+		t.Fatal("the test ROM code overlaps its data")
+	}
+	code := make([]byte, spriteDataBase+len(data))
+	copy(code, rom)
+	copy(code[spriteDataBase:], data)
+	return writeTestROM(t, code...)
+}
+
+// renderSprites emulates two frames of rom and returns the second
+// one, along with the status register read at the end of its display.
+func renderSprites(t *testing.T, rom string, spriteLimit bool) (*smslib.DisplayData, byte) {
+	var out bytes.Buffer
+	debugger := smslib.NewDebugger(strings.NewReader(""), &out)
+	w, err := smslib.ParseWatchpoint("port bf r log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugger.Watch(w)
+	sms := smslib.NewSMS()
+	sms.LoadROM(rom)
+	sms.SetSpriteLimit(spriteLimit)
+	sms.AttachDebugger(debugger)
+	sms.RenderFrame().Release()
+	frame := sms.RenderFrame()
+	var status byte
+	reads := 0
+	for _, line := range strings.Split(out.String(), "\n") {
+		if _, err := fmt.Sscanf(line, "Read 0x%02x from port 0xbf", &status); err == nil {
+			reads++
+		}
+	}
+	if reads != 2 {
+		t.Fatalf("the status register was read %d times, want 2:\n%s", reads, out.String())
+	}
+	return frame, status
+}
+
+// spriteRegisters returns the VDP registers of a 192-line Mode 4
+// display with the sprites at 0x3f00, their tiles at 0x2000 and the
+// given register 1 bits set besides the display enable bit.
+func spriteRegisters(reg1 byte) [11]byte {
+	return [11]byte{0x04, 0x40 | reg1, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0xff}
+}
+
+// checkRow checks the color indexes of line y from x onwards.
+func checkRow(t *testing.T, frame *smslib.DisplayData, y, x int, want ...byte) {
+	t.Helper()
+	got := frame.Pixels[y*smslib.DISPLAY_WIDTH+x : y*smslib.DISPLAY_WIDTH+x+len(want)]
+	if !bytes.Equal(got, want) {
+		t.Errorf("line %d from x=%d: got %v, want %v", y, x, got, want)
+	}
+}
+
+func TestSpritePatternBase(t *testing.T) {
+	// Tile 1 differs at 0x0020 and 0x2020: register 6 selects the
+	// latter.
+	rom := vdpROM(t, spriteRegisters(0),
+		vramWrite{0x0020, solidTile(2)},
+		vramWrite{0x2020, solidTile(1)},
+		spriteAttributes(spriteEntry{x: 16, y: 9, tile: 1}))
+	frame, status := renderSprites(t, rom, true)
+	defer frame.Release()
+	// Sprites are shown one line below their Y coordinate
+	checkRow(t, frame, 9, 15, 0, 0, 0)
+	for y := 10; y < 18; y++ {
+		checkRow(t, frame, y, 15, 0, 17, 17, 17, 17, 17, 17, 17, 17, 0)
+	}
+	checkRow(t, frame, 18, 16, 0, 0)
+	if status&0x60 != 0 {
+		t.Errorf("status 0x%02x reports an overflow or a collision", status)
+	}
+}
+
+func TestZoomedSprites(t *testing.T) {
+	rom := vdpROM(t, spriteRegisters(0x01),
+		vramWrite{0x2020, spriteTile(1, 2, 2, 2, 2, 2, 2, 3)},
+		spriteAttributes(spriteEntry{x: 16, y: 9, tile: 1}))
+	frame, _ := renderSprites(t, rom, true)
+	defer frame.Release()
+	for y := 10; y < 26; y++ {
+		checkRow(t, frame, y, 15, 0, 17, 17, 18, 18, 18, 18, 18, 18, 18, 18, 18, 18, 18, 18, 19, 19, 0)
+	}
+	checkRow(t, frame, 26, 16, 0, 0)
+}
+
+func TestTallSprites(t *testing.T) {
+	// 8x16 sprites use an even tile and the next one, whatever the
+	// lowest bit of the tile number.
+	rom := vdpROM(t, spriteRegisters(0x02),
+		vramWrite{0x2040, append(solidTile(1), solidTile(2)...)},
+		spriteAttributes(spriteEntry{x: 16, y: 9, tile: 3}))
+	frame, _ := renderSprites(t, rom, true)
+	defer frame.Release()
+	for y := 10; y < 18; y++ {
+		checkRow(t, frame, y, 16, 17)
+	}
+	for y := 18; y < 26; y++ {
+		checkRow(t, frame, y, 16, 18)
+	}
+	checkRow(t, frame, 26, 16, 0)
+}
+
+func TestSpriteLimit(t *testing.T) {
+	var sprites []spriteEntry
+	for i := 0; i < 9; i++ {
+		sprites = append(sprites, spriteEntry{x: byte(16 * i), y: 9, tile: 1})
+	}
+	rom := vdpROM(t, spriteRegisters(0), vramWrite{0x2020, solidTile(1)}, spriteAttributes(sprites...))
+	for _, limit := range []bool{true, false} {
+		frame, status := renderSprites(t, rom, limit)
+		checkRow(t, frame, 10, 112, 17)
+		if limit {
+			checkRow(t, frame, 10, 128, 0)
+		} else {
+			checkRow(t, frame, 10, 128, 17)
+		}
+		frame.Release()
+		if status&0x40 == 0 {
+			t.Errorf("limit %t: status 0x%02x lacks the overflow flag", limit, status)
+		}
+		if status&0x20 != 0 {
+			t.Errorf("limit %t: status 0x%02x reports a collision", limit, status)
+		}
+	}
+}
+
+func TestSpriteCollision(t *testing.T) {
+	// The left half of tile 1 is opaque, tile 2 is solid.
+	tiles := vramWrite{0x2020, append(spriteTile(1, 1, 1, 1), solidTile(2)...)}
+	for _, c := range []struct {
+		x         byte
+		collision bool
+	}{
+		{x: 19, collision: true},
+		{x: 20, collision: false}, // Over the transparent half
+	} {
+		rom := vdpROM(t, spriteRegisters(0), tiles,
+			spriteAttributes(spriteEntry{x: 16, y: 9, tile: 1}, spriteEntry{x: c.x, y: 9, tile: 2}))
+		frame, status := renderSprites(t, rom, true)
+		// The first sprite of the table is drawn in front
+		checkRow(t, frame, 10, 16, 17, 17, 17, 17)
+		checkRow(t, frame, 10, 20, 18, 18, 18)
+		frame.Release()
+		if got := status&0x20 != 0; got != c.collision {
+			t.Errorf("second sprite at x=%d: status 0x%02x, want collision %t", c.x, status, c.collision)
+		}
+	}
+}
+
+func TestSpritesAtTheRightEdge(t *testing.T) {
+	rom := vdpROM(t, spriteRegisters(0), vramWrite{0x2020, solidTile(1)},
+		spriteAttributes(spriteEntry{x: 252, y: 9, tile: 1}))
+	frame, _ := renderSprites(t, rom, true)
+	defer frame.Release()
+	checkRow(t, frame, 10, 250, 0, 0, 17, 17, 17, 17)
+	// Sprites don't wrap around to the left edge
+	checkRow(t, frame, 10, 0, 0, 0, 0, 0)
+}
+
+func TestSpritesShiftedLeft(t *testing.T) {
+	// Bit 3 of register 0 moves the sprites 8 pixels to the left.
+	regs := spriteRegisters(0)
+	regs[0] |= 0x08
+	rom := vdpROM(t, regs, vramWrite{0x2020, solidTile(1)},
+		spriteAttributes(spriteEntry{x: 4, y: 9, tile: 1}, spriteEntry{x: 24, y: 9, tile: 1}))
+	frame, _ := renderSprites(t, rom, true)
+	defer frame.Release()
+	// The first sprite is partly hidden past the left edge
+	checkRow(t, frame, 10, 0, 17, 17, 17, 17, 0)
+	checkRow(t, frame, 10, 15, 0, 17, 17, 17, 17, 17, 17, 17, 17, 0)
+}
@@ -0,0 +1,42 @@
+package z80
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Starting a log between frames must not set its start ahead of the
+// next sound chip writes.
+func TestVGMLogStartedBetweenFrames(t *testing.T) {
+	sms := newHeadlessSMS()
+	filename := filepath.Join(t.TempDir(), "music.vgm")
+	if err := sms.StartVGMLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	sms.RenderFrame().Release()
+	if err := sms.StopVGMLog(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A frame lasts 313 lines of 227 cycles, about 883 samples
+	if samples := binary.LittleEndian.Uint32(data[0x18:]); samples < 880 || samples > 886 {
+		t.Errorf("one frame logged as %d samples", samples)
+	}
+	wait := 0
+	switch data[0x40] {
+	case 0x61:
+		wait = int(binary.LittleEndian.Uint16(data[0x41:]))
+	case 0x62:
+		wait = 735
+	case 0x63:
+		wait = 882
+	}
+	if wait > 886 {
+		t.Errorf("first wait of %d samples", wait)
+	}
+}
@@ -0,0 +1,139 @@
+package z80
+
+import (
+	"bytes"
+	smslib "github.com/remogatto/sms/segamastersystem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseWatchpoint(t *testing.T) {
+	for spec, want := range map[string]string{
+		"c000":              "0xc000 w",
+		"e000":              "0xc000 w",
+		"0xfffd:rw:changed": "0xfffd rw changed",
+		"port bf w =87 log": "port 0xbf w =87 log",
+		"port:81":           "port 0xbf w",
+		"port:dc:r":         "port 0xdc r",
+	} {
+		w, err := smslib.ParseWatchpoint(spec)
+		if err != nil {
+			t.Errorf("%q: %s", spec, err)
+			continue
+		}
+		if got := w.String(); got != want {
+			t.Errorf("%q parsed as %q, want %q", spec, got, want)
+		}
+	}
+	for _, spec := range []string{"", "port", "port 100", "c000 x", "c000 =zz"} {
+		if _, err := smslib.ParseWatchpoint(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+// watchFrame emulates the first frame of rom with the given
+// watchpoints and debugger commands, returning the debugger output.
+func watchFrame(t *testing.T, rom, commands string, specs ...string) string {
+	var out bytes.Buffer
+	debugger := smslib.NewDebugger(strings.NewReader(commands), &out)
+	for _, spec := range specs {
+		w, err := smslib.ParseWatchpoint(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		debugger.Watch(w)
+	}
+	sms := smslib.NewSMS()
+	sms.LoadROM(rom)
+	sms.AttachDebugger(debugger)
+	sms.RenderFrame().Release()
+	return out.String()
+}
+
+// writeTestROM writes a 32 KB ROM starting with code.
+func writeTestROM(t *testing.T, code ...byte) string {
+	rom := make([]byte, 0x8000)
+	copy(rom, code)
+	filename := filepath.Join(t.TempDir(), "test.sms")
+	if err := ioutil.WriteFile(filename, rom, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// mapperROM selects pages 1, 1 and 0 for slot 1, then writes to the
+// VDP control port through a mirror.
+var mapperROM = []byte{
+	0xf3,       // 0x0000 di
+	0x3e, 0x01, // 0x0001 ld a,1
+	0x32, 0xfe, 0xff, // 0x0003 ld (0xfffe),a
+	0x32, 0xfe, 0xff, // 0x0006 ld (0xfffe),a
+	0x3e, 0x00, // 0x0009 ld a,0
+	0x32, 0xfe, 0xff, // 0x000b ld (0xfffe),a
+	0x3e, 0x81, // 0x000e ld a,0x81
+	0xd3, 0xbd, // 0x0010 out (0xbd),a
+	0x76, // 0x0012 halt
+}
+
+func TestWatchpointConditions(t *testing.T) {
+	rom := writeTestROM(t, mapperROM...)
+	for spec, want := range map[string][]string{
+		// Page 1 is already selected at power on
+		"fffe log":         {"0x01 to 0xfffe by 0x0003", "0x01 to 0xfffe by 0x0006", "0x00 to 0xfffe by 0x000b"},
+		"fffe =01 log":     {"0x01 to 0xfffe by 0x0003", "0x01 to 0xfffe by 0x0006"},
+		"fffe changed log": {"0x00 to 0xfffe by 0x000b"},
+		"port bf log":      {"0x81 to port 0xbd by 0x0010"},
+		"fffe r log":       nil,
+	} {
+		var got []string
+		for _, line := range strings.Split(watchFrame(t, rom, "", spec), "\n") {
+			if strings.HasPrefix(line, "Write ") {
+				line = strings.TrimPrefix(line, "Write ")
+				got = append(got, line[:strings.Index(line, " at cycle ")])
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%q logged %q, want %q", spec, got, want)
+		}
+	}
+}
+
+func TestWatchpointStopsAfterTheAccess(t *testing.T) {
+	out := watchFrame(t, writeTestROM(t, mapperROM...), "continue\n", "fffe =00")
+	for _, want := range []string{"Write 0x00 to 0xfffe by 0x000b at cycle ", "Watchpoint at 0x000e"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("debugger output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWatchpointsOnBlockhead(t *testing.T) {
+	// The VDP registers are set up with an otir, then the first
+	// call pushes its return address below 0xdff0.
+	out := watchFrame(t, "../roms/blockhead.sms", "", "port bf =81 log", "ffee changed log")
+	for _, want := range []string{
+		"Write 0x81 to port 0xbf by 0x0079 at cycle ",
+		"Write 0x86 to 0xdfee by 0x0083 at cycle ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("debugger output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestDebuggerReadsDoNotSetOffWatchpoints(t *testing.T) {
+	var out bytes.Buffer
+	debugger := smslib.NewDebugger(strings.NewReader("disasm d000\nmem d000 16\n"), &out)
+	w, _ := smslib.ParseWatchpoint("d000 r log")
+	debugger.Watch(w)
+	sms := smslib.NewSMS()
+	sms.LoadROM("../roms/blockhead.sms")
+	sms.AttachDebugger(debugger)
+	sms.Debug()
+	if strings.Contains(out.String(), "Read ") {
+		t.Errorf("the debugger set off a watchpoint:\n%s", out.String())
+	}
+}